@@ -2,12 +2,11 @@ package main
 
 import (
 	"os"
+	"sshtools/internal/pkg/exitcode"
 	"sshtools/internal/rexec"
 )
 
 func main() {
 	cmd := rexec.NewRExecCommand()
-	if err := cmd.Execute(); err != nil {
-		os.Exit(1)
-	}
+	os.Exit(exitcode.FromError(cmd.Execute()))
 }
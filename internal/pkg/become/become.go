@@ -0,0 +1,307 @@
+package become
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"sshtools/internal/pkg/shell"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Privilege escalation methods
+const (
+	MethodSudo = "sudo"
+	MethodSu   = "su"
+)
+
+// Methods lists the accepted become methods
+var Methods = []string{MethodSudo, MethodSu}
+
+// suPrompt matches the password prompt of su, which can't be changed
+var suPrompt = regexp.MustCompile(`(?i)(password|passwort)[^\n]*:\s*$`)
+
+// Become runs commands as another user on the server
+type Become struct {
+	Method string
+	// User is the user to run commands as, root when empty
+	User string
+	// Password answers the sudo or su password prompt
+	Password string
+	// Pty runs sudo on a terminal too, for hosts with Defaults requiretty
+	Pty bool
+}
+
+// Validate returns an error if method is not a known become method
+func Validate(method string) error {
+	for _, m := range Methods {
+		if m == method {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid become method %q, must be one of %s", method, strings.Join(Methods, ","))
+}
+
+// NeedsPty reports whether the command runs on a terminal, as su always
+// does, in which case stdout and stderr of the command are merged
+func (b *Become) NeedsPty() bool {
+	return b.Method == MethodSu || b.Pty
+}
+
+// TargetUser returns the user commands run as
+func (b *Become) TargetUser() string {
+	if b.User == "" {
+		return "root"
+	}
+	return b.User
+}
+
+// Process is a command started with Start
+type Process struct {
+	become *Become
+	marker string
+	prompt string
+	stdin  io.WriteCloser
+	input  io.Reader
+
+	mu      sync.Mutex
+	ready   bool
+	prompts int
+	// output before the marker, reported when the command never runs
+	log bytes.Buffer
+	// stderr received since the last prompt, it belongs to the command if
+	// the marker follows
+	pending bytes.Buffer
+	stdout  io.Writer
+	stderr  io.Writer
+	err     error
+}
+
+// Start starts cmd in session as b.User. The password prompt is answered
+// over the session's stdin, then stdin is copied to the command. stdout and
+// stderr only receive the output of cmd.
+func (b *Become) Start(session *ssh.Session, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*Process, error) {
+	marker, err := newMarker()
+	if err != nil {
+		return nil, err
+	}
+	p := &Process{
+		become: b,
+		marker: marker,
+		prompt: fmt.Sprintf("[sshtools %s] password: ", marker),
+		input:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	if b.NeedsPty() {
+		modes := ssh.TerminalModes{ssh.ECHO: 0}
+		if err := session.RequestPty("xterm", 40, 200, modes); err != nil {
+			return nil, fmt.Errorf("failed to request a pty for %s, %s", b.Method, err)
+		}
+	}
+	p.stdin, err = session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	session.Stdout = &stdoutFilter{p: p}
+	session.Stderr = &stderrFilter{p: p}
+
+	if err := session.Start(p.command(cmd)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// command returns cmd wrapped to run as the become user. The wrapper prints
+// the marker once the user is switched, so the output before it is known
+// to come from sudo or su.
+func (p *Process) command(cmd string) string {
+	user := p.become.TargetUser()
+	script := fmt.Sprintf("echo %s\n%s", p.marker, cmd)
+
+	if p.become.Method == MethodSu {
+		return fmt.Sprintf("su -s /bin/sh %s -c %s", shell.Quote(user), shell.Quote(script))
+	}
+	return fmt.Sprintf("sudo -H -S -p %s -u %s -- /bin/sh -c %s",
+		shell.Quote(p.prompt), shell.Quote(user), shell.Quote(script))
+}
+
+// Err returns why the command didn't run as the become user, call it once
+// the session is done
+func (p *Process) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ready {
+		return nil
+	}
+	if p.err != nil {
+		return p.err
+	}
+	msg := strings.TrimSpace(strings.ReplaceAll(p.log.String(), p.prompt, ""))
+	if msg == "" {
+		msg = "no output"
+	}
+	return fmt.Errorf("%s failed, %s", p.become.Method, msg)
+}
+
+// answer writes the password to the prompt, a second prompt means the
+// password was rejected
+func (p *Process) answer() {
+	p.prompts++
+	p.pending.Reset()
+	switch {
+	case p.become.Password == "":
+		p.err = fmt.Errorf("%s requires a password, use --ask-become-pass or becomePassword", p.become.Method)
+	case p.prompts > 1:
+		p.err = fmt.Errorf("incorrect %s password", p.become.Method)
+	default:
+		io.WriteString(p.stdin, p.become.Password+"\n")
+		return
+	}
+	p.stdin.Close()
+}
+
+// start is called when the marker is seen, the command is running
+func (p *Process) start() {
+	p.ready = true
+	if p.pending.Len() > 0 {
+		p.stderr.Write(p.pending.Bytes())
+		p.pending.Reset()
+	}
+	go func() {
+		w := &lastByteWriter{w: p.stdin, last: '\n'}
+		if p.input != nil {
+			io.Copy(w, p.input)
+		}
+		if p.become.NeedsPty() {
+			// Closing stdin doesn't end the input on a pty, the command
+			// gets EOF from ^D at the start of a line, a partial line takes
+			// one more to be flushed first
+			eof := "\x04"
+			if w.last != '\n' {
+				eof += "\x04"
+			}
+			io.WriteString(p.stdin, eof)
+		}
+		p.stdin.Close()
+	}()
+}
+
+// lastByteWriter remembers the last byte written through it
+type lastByteWriter struct {
+	w    io.Writer
+	last byte
+}
+
+func (w *lastByteWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if n > 0 {
+		w.last = b[n-1]
+	}
+	return n, err
+}
+
+type stdoutFilter struct {
+	p   *Process
+	buf bytes.Buffer
+	// cr holds a trailing carriage return, pty output ends lines with \r\n
+	cr bool
+}
+
+func (f *stdoutFilter) Write(b []byte) (int, error) {
+	p := f.p
+	p.mu.Lock()
+	if p.ready {
+		// Only the session writes stdout, once ready it needs no lock
+		p.mu.Unlock()
+		return len(b), f.write(b)
+	}
+	defer p.mu.Unlock()
+
+	f.buf.Write(b)
+	p.log.Write(b)
+	s := f.buf.String()
+	// On a terminal the sudo prompt, which holds the marker too, comes on
+	// stdout
+	out := strings.ReplaceAll(s, p.prompt, "")
+	if i := strings.Index(out, p.marker); i >= 0 {
+		rest := strings.TrimPrefix(out[i+len(p.marker):], "\r")
+		if !strings.HasPrefix(rest, "\n") {
+			// The end of the marker line is yet to come
+			return len(b), nil
+		}
+		f.buf.Reset()
+		p.start()
+		return len(b), f.write([]byte(rest[1:]))
+	}
+	if p.become.NeedsPty() && p.isPrompt(s) {
+		f.buf.Reset()
+		p.answer()
+	}
+	return len(b), nil
+}
+
+// isPrompt reports whether s ends with the password prompt, which comes on
+// stdout when the command runs on a terminal
+func (p *Process) isPrompt(s string) bool {
+	if p.become.Method == MethodSu {
+		return suPrompt.MatchString(s)
+	}
+	return strings.HasSuffix(s, p.prompt)
+}
+
+// write passes output of the command on, converting pty line endings
+func (f *stdoutFilter) write(b []byte) error {
+	if !f.p.become.NeedsPty() {
+		_, err := f.p.stdout.Write(b)
+		return err
+	}
+	s := string(b)
+	if f.cr {
+		s = "\r" + s
+		f.cr = false
+	}
+	if strings.HasSuffix(s, "\r") {
+		s = s[:len(s)-1]
+		f.cr = true
+	}
+	_, err := io.WriteString(f.p.stdout, strings.ReplaceAll(s, "\r\n", "\n"))
+	return err
+}
+
+type stderrFilter struct {
+	p *Process
+}
+
+func (f *stderrFilter) Write(b []byte) (int, error) {
+	p := f.p
+	p.mu.Lock()
+	if p.ready {
+		p.mu.Unlock()
+		return p.stderr.Write(b)
+	}
+	defer p.mu.Unlock()
+
+	p.log.Write(b)
+	p.pending.Write(b)
+	if bytes.HasSuffix(p.pending.Bytes(), []byte(p.prompt)) {
+		p.answer()
+	}
+	return len(b), nil
+}
+
+func newMarker() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.New("failed to generate the become marker")
+	}
+	return "SSHTOOLS-BECOME-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,252 @@
+// Package cli holds the flags and the run setup shared by rexec and rcp
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sshtools/internal/pkg/become"
+	"sshtools/internal/pkg/exitcode"
+	"sshtools/internal/pkg/output"
+	"sshtools/internal/pkg/pool"
+	"sshtools/internal/pkg/sshconn"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// AddFlags adds the flags connecting to the hosts and running on them
+func AddFlags(flags *pflag.FlagSet) {
+	flags.StringP("username", "u", "root", "The ssh server username")
+	flags.StringP("password", "p", "", "The ssh server password")
+	flags.StringArrayP("identity", "i", nil, "A private key file for publickey authentication, may be given multiple times")
+	flags.String("certificate", "", "An OpenSSH user certificate for publickey authentication, '<key>-cert.pub' next to each private key is used by default")
+	flags.String("passphrase-env", "", "The environment variable holding the passphrase of encrypted private keys, without it the passphrase is read from SSH_ASKPASS or prompted on the terminal")
+	flags.StringSlice("auth-methods", nil, fmt.Sprintf("The ordered auth chain, any of %s. Defaults to agent (if SSH_AUTH_SOCK is set), publickey, password and keyboard-interactive depending on the credentials given", strings.Join(sshconn.AuthMethods, "|")))
+	flags.Duration("connect-timeout", sshconn.DefaultConnectTimeout, "The timeout of each connection attempt, including the ssh handshake. Hosts in the configuration file may override it with 'connectTimeout'")
+	flags.Int("retries", 0, "The number of times a failed connection is retried with exponential backoff, auth and host key failures are not retried. Hosts in the configuration file may override it with 'retries'")
+	flags.Duration("retry-delay", sshconn.DefaultRetryDelay, "The delay before the first retry, doubled on every retry with some jitter. Hosts in the configuration file may override it with 'retryDelay'")
+	flags.BoolP("become", "b", false, "Run as another user with sudo or su. Hosts in the configuration file may override it with 'become'")
+	flags.String("become-user", "root", "The user to become. Hosts in the configuration file may override it with 'becomeUser'")
+	flags.String("become-method", become.MethodSudo, fmt.Sprintf("How to become the user, one of %s. Hosts in the configuration file may override it with 'becomeMethod'", strings.Join(become.Methods, "|")))
+	flags.Bool("become-pty", false, "Run sudo on a terminal too, for hosts with 'Defaults requiretty'. stdout and stderr are then merged, file transfers don't support it. Hosts in the configuration file may override it with 'becomePty'")
+	flags.BoolP("ask-become-pass", "K", false, "Prompt once for the sudo or su password, hosts may set it with 'becomePassword' instead. sudo uses the ssh password by default")
+	flags.Int("forks", 32, "The maximum number of hosts connecting or worked on at the same time, 0 means no limit. Connections stay open until the run ends")
+	flags.StringToString("group-forks", nil, "'group=N,...', The maximum number of hosts of a group worked on at the same time, hosts join a group with 'group' in the configuration file")
+	flags.Int("min-success", 0, "Abort before running anything unless at least this many hosts are connected")
+	flags.Int("max-failures", -1, "Abort before running anything if more than this many hosts fail to connect, -1 means no limit")
+	flags.BoolP("verbose", "v", false, "Print connection details such as the auth chain and the method that succeeded")
+	flags.StringP("ssh-config", "F", "~/.ssh/config", "The OpenSSH client config resolving host aliases in addrs to HostName, Port, User, IdentityFile and ProxyJump, 'none' to disable it")
+	flags.StringP("jump", "J", "", "'[user@]host[:port],...', Jump hosts to connect through, like the ssh ProxyJump option. Hosts in the configuration file may override it with 'proxyJump'")
+	flags.String("host-key-policy", sshconn.HostKeyStrict, fmt.Sprintf("How to verify ssh server host keys, one of %s. Hosts in the configuration file may override it with 'hostKeyPolicy'", strings.Join(sshconn.HostKeyPolicies, "|")))
+	flags.String("known-hosts", "", "An extra known_hosts file read in addition to ~/.ssh/known_hosts, new host keys are recorded in it with the accept-new policy")
+	flags.Duration("timeout", 0, "The maximum time spent on each host once connected, e.g. 30s or 5m, hosts exceeding it are reported as timed out. 0 means no limit")
+	flags.Duration("total-timeout", 0, "The maximum time of the whole run, hosts not done by then are reported as timed out. 0 means no limit")
+	flags.StringP("output", "o", output.Text, fmt.Sprintf("The output format, one of %s. Formats other than text print one result per host and a summary for scripts", strings.Join(output.Formats, "|")))
+}
+
+// HostConfigs returns the hosts of --addrs or of the configuration file,
+// the settings a host leaves out are taken from the flags and the ssh config
+func HostConfigs() ([]sshconn.Config, error) {
+	cfgs := []sshconn.Config{}
+
+	sshConfig := &sshconn.SSHConfig{}
+	if path := viper.GetString("ssh-config"); path != "none" && path != "" {
+		c, err := sshconn.LoadSSHConfig(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ssh config, %s", err)
+		}
+		sshConfig = c
+	}
+
+	becomePassword := ""
+	if viper.GetBool("ask-become-pass") {
+		p, err := sshconn.ReadPassword("BECOME password: ")
+		if err != nil {
+			return nil, err
+		}
+		becomePassword = p
+	}
+
+	addrs := viper.Get("addrs")
+	v, ok := addrs.(string)
+	keepUsername := !ok || viper.IsSet("username")
+	if ok {
+		l := strings.Split(v, ",")
+		for _, addr := range l {
+			cfg := sshconn.Config{
+				Addr:     addr,
+				Username: viper.GetString("username"),
+				Password: viper.GetString("password"),
+			}
+			cfgs = append(cfgs, cfg)
+		}
+	} else {
+		viper.UnmarshalKey("addrs", &cfgs)
+	}
+
+	for i, v := range cfgs {
+		if len(v.PrivateKeyPaths) == 0 {
+			v.PrivateKeyPaths = viper.GetStringSlice("identity")
+		}
+		if v.CertificatePath == "" {
+			v.CertificatePath = viper.GetString("certificate")
+		}
+		if v.PassphraseEnv == "" {
+			v.PassphraseEnv = viper.GetString("passphrase-env")
+		}
+		if len(v.AuthMethods) == 0 {
+			v.AuthMethods = viper.GetStringSlice("auth-methods")
+		}
+		if err := sshconn.ValidateAuthMethods(v.AuthMethods); err != nil {
+			return nil, fmt.Errorf("Host %s: %s", v.Addr, err)
+		}
+		if v.ProxyJump == "" {
+			v.ProxyJump = viper.GetString("jump")
+		}
+		if v.ConnectTimeout == 0 {
+			v.ConnectTimeout = viper.GetDuration("connect-timeout")
+		}
+		// A host setting retries, become or becomePty overrides the flag
+		// even with 0 or false
+		if v.Retries == nil {
+			retries := viper.GetInt("retries")
+			v.Retries = &retries
+		}
+		if v.RetryDelay == 0 {
+			v.RetryDelay = viper.GetDuration("retry-delay")
+		}
+		if v.Become == nil {
+			b := viper.GetBool("become")
+			v.Become = &b
+		}
+		if v.BecomeUser == "" {
+			v.BecomeUser = viper.GetString("become-user")
+		}
+		if v.BecomeMethod == "" {
+			v.BecomeMethod = viper.GetString("become-method")
+		}
+		if err := become.Validate(v.BecomeMethod); err != nil {
+			return nil, fmt.Errorf("Host %s: %s", v.Addr, err)
+		}
+		if v.BecomePty == nil {
+			b := viper.GetBool("become-pty")
+			v.BecomePty = &b
+		}
+		if v.BecomePassword == "" {
+			v.BecomePassword = becomePassword
+		}
+		if v.BecomePassword == "" && v.BecomeMethod == become.MethodSudo {
+			v.BecomePassword = v.Password
+		}
+		if v.HostKeyPolicy == "" {
+			v.HostKeyPolicy = viper.GetString("host-key-policy")
+		}
+		if v.KnownHostsFile == "" {
+			v.KnownHostsFile = viper.GetString("known-hosts")
+		}
+		if err := sshconn.ValidateHostKeyPolicy(v.HostKeyPolicy); err != nil {
+			return nil, fmt.Errorf("Host %s: %s", v.Addr, err)
+		}
+		v = sshConfig.Apply(v, keepUsername)
+		if err := sshconn.CheckConfig(v); err != nil {
+			return nil, fmt.Errorf("Host %s: %s", v.Addr, err)
+		}
+		cfgs[i] = v
+
+		addrS := strings.Split(v.Addr, ":")
+		if len(addrS) == 2 {
+			continue
+		}
+		if len(addrS) == 1 {
+			defaultPort := "22"
+			addr := fmt.Sprintf("%s:%s", addrS[0], defaultPort)
+			v.Addr = addr
+			cfgs[i] = v
+			continue
+		}
+		return nil, fmt.Errorf("Host addr %s is incorrect", v.Addr)
+	}
+
+	return cfgs, nil
+}
+
+// NewPool returns the pool bounding the hosts worked on by --forks and
+// --group-forks
+func NewPool() (*pool.Pool, error) {
+	groupForks := map[string]int{}
+	for group, v := range viper.GetStringMapString("group-forks") {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forks %q of group %s", v, group)
+		}
+		groupForks[group] = n
+	}
+	return pool.New(viper.GetInt("forks"), groupForks), nil
+}
+
+// NewContext returns the context of a run, cancelled by SIGINT or SIGTERM
+// and bounded by --total-timeout. A second signal kills the process.
+func NewContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	timeout := viper.GetDuration("total-timeout")
+	if timeout <= 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// CheckConnected decides whether to go on with the connected hosts when some
+// of them failed to connect
+func CheckConnected(total, failed int) error {
+	connected := total - failed
+	if minSuccess := viper.GetInt("min-success"); connected < minSuccess {
+		return fmt.Errorf("only %d of %d hosts connected, at least %d required", connected, total, minSuccess)
+	}
+	if maxFailures := viper.GetInt("max-failures"); maxFailures >= 0 && failed > maxFailures {
+		return fmt.Errorf("%d of %d hosts failed to connect, at most %d allowed", failed, total, maxFailures)
+	}
+	return nil
+}
+
+// AttemptsNote mentions the connection attempts of hosts that needed retries
+func AttemptsNote(attempts int) string {
+	if attempts <= 1 {
+		return ""
+	}
+	return fmt.Sprintf(" (%d connection attempts)", attempts)
+}
+
+// Unreachable reports whether err is the one of a host that could not be
+// connected to
+func Unreachable(err error) bool {
+	var connErr *sshconn.ConnectError
+	return errors.As(err, &connErr)
+}
+
+// ResultError returns the error carrying the exit code of a run, errs holds
+// the error of every host and failed the number of hosts that failed, with
+// an error or otherwise
+func ResultError(errs []error, failed int) error {
+	unreachable := 0
+	for _, err := range errs {
+		if Unreachable(err) {
+			unreachable++
+		}
+	}
+	return exitcode.FromCounts(len(errs), failed, unreachable)
+}
@@ -0,0 +1,74 @@
+package exitcode
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Process exit codes of rexec and rcp
+const (
+	// OK means every host succeeded
+	OK = 0
+	// SomeFailed means some hosts failed, the others succeeded
+	SomeFailed = 1
+	// AllFailed means every host failed
+	AllFailed = 2
+	// Unreachable means some hosts could not be connected to, or too many of
+	// them to go on with the others. It takes precedence over SomeFailed and
+	// AllFailed.
+	Unreachable = 3
+	// Usage means invalid flags, arguments or configuration, nothing was run
+	Usage = 4
+)
+
+// Error carries the exit code of a command
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New wraps err with code
+func New(code int, err error) error {
+	return &Error{Code: code, Err: err}
+}
+
+// Errorf formats an error with code
+func Errorf(code int, format string, a ...interface{}) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, a...)}
+}
+
+// FromError returns the exit code of the error returned by a command.
+// Errors without a code come from cobra parsing the command line.
+func FromError(err error) int {
+	if err == nil {
+		return OK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return Usage
+}
+
+// FromCounts returns the exit code and error of a run on total hosts,
+// failed of them including the unreachable ones
+func FromCounts(total, failed, unreachable int) error {
+	switch {
+	case unreachable > 0:
+		return Errorf(Unreachable, "%d of %d hosts failed, %d of them unreachable", failed, total, unreachable)
+	case failed == 0:
+		return nil
+	case failed == total:
+		return Errorf(AllFailed, "all %d hosts failed", total)
+	default:
+		return Errorf(SomeFailed, "%d of %d hosts failed", failed, total)
+	}
+}
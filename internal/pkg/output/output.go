@@ -0,0 +1,169 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gosuri/uitable"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats, Text is the coloured human readable output printed by the
+// tools themselves
+const (
+	Text   = "text"
+	JSON   = "json"
+	NDJSON = "ndjson"
+	YAML   = "yaml"
+	Table  = "table"
+)
+
+// Formats lists the accepted output formats
+var Formats = []string{Text, JSON, NDJSON, YAML, Table}
+
+// Host statuses
+const (
+	StatusOK          = "ok"
+	StatusFailed      = "failed"
+	StatusUnreachable = "unreachable"
+	StatusTimedOut    = "timed-out"
+	StatusCancelled   = "cancelled"
+)
+
+// Result is the machine readable result of a host. Fields are always
+// present so consumers can rely on the schema.
+type Result struct {
+	Type       string `json:"type" yaml:"type"`
+	Host       string `json:"host" yaml:"host"`
+	Status     string `json:"status" yaml:"status"`
+	ExitStatus int    `json:"exitStatus" yaml:"exitStatus"`
+	Signal     string `json:"signal" yaml:"signal"`
+	Stdout     string `json:"stdout" yaml:"stdout"`
+	Stderr     string `json:"stderr" yaml:"stderr"`
+	Output     string `json:"output" yaml:"output"`
+	Error      string `json:"error" yaml:"error"`
+	DurationMs int64  `json:"durationMs" yaml:"durationMs"`
+	Bytes      int64  `json:"bytesTransferred" yaml:"bytesTransferred"`
+	Attempts   int    `json:"attempts" yaml:"attempts"`
+	// KeptScript is the script left on the host by rexec --keep-remote
+	KeptScript string `json:"keptScript" yaml:"keptScript"`
+}
+
+// Summary counts the hosts by status
+type Summary struct {
+	Type        string `json:"type" yaml:"type"`
+	Total       int    `json:"total" yaml:"total"`
+	OK          int    `json:"ok" yaml:"ok"`
+	Failed      int    `json:"failed" yaml:"failed"`
+	Unreachable int    `json:"unreachable" yaml:"unreachable"`
+	TimedOut    int    `json:"timedOut" yaml:"timedOut"`
+	Cancelled   int    `json:"cancelled" yaml:"cancelled"`
+}
+
+type document struct {
+	Results []Result `json:"results" yaml:"results"`
+	Summary Summary  `json:"summary" yaml:"summary"`
+}
+
+// NewResult creates the result of host, the status is derived from err and
+// unreachable
+func NewResult(host string, err error, unreachable bool, duration time.Duration) Result {
+	r := Result{
+		Type:       "result",
+		Host:       host,
+		Status:     StatusOK,
+		DurationMs: duration.Milliseconds(),
+	}
+	if err != nil {
+		r.Status = StatusFailed
+		r.Error = err.Error()
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		r.Status = StatusTimedOut
+	case errors.Is(err, context.Canceled):
+		r.Status = StatusCancelled
+	}
+	if unreachable {
+		r.Status = StatusUnreachable
+	}
+	return r
+}
+
+// NewSummary counts results by status
+func NewSummary(results []Result) Summary {
+	s := Summary{Type: "summary", Total: len(results)}
+	for _, r := range results {
+		switch r.Status {
+		case StatusOK:
+			s.OK++
+		case StatusFailed:
+			s.Failed++
+		case StatusUnreachable:
+			s.Unreachable++
+		case StatusTimedOut:
+			s.TimedOut++
+		case StatusCancelled:
+			s.Cancelled++
+		}
+	}
+	return s
+}
+
+// ValidateFormat returns an error if format is not a known output format
+func ValidateFormat(format string) error {
+	for _, f := range Formats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid output format %q, must be one of %s", format, strings.Join(Formats, ","))
+}
+
+// Print writes results followed by their summary to w in format, which must
+// not be Text
+func Print(w io.Writer, format string, results []Result) error {
+	summary := NewSummary(results)
+
+	switch format {
+	case JSON:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(document{Results: results, Summary: summary})
+	case NDJSON:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		for _, r := range results {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return enc.Encode(summary)
+	case YAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(document{Results: results, Summary: summary}); err != nil {
+			return err
+		}
+		return enc.Close()
+	case Table:
+		table := uitable.New()
+		table.MaxColWidth = 80
+		table.AddRow("HOST", "STATUS", "EXIT", "DURATION", "BYTES", "ATTEMPTS", "ERROR")
+		for _, r := range results {
+			duration := (time.Duration(r.DurationMs) * time.Millisecond).String()
+			table.AddRow(r.Host, r.Status, r.ExitStatus, duration, r.Bytes, r.Attempts, r.Error)
+		}
+		_, err := fmt.Fprintf(w, "%s\n\ntotal: %d, ok: %d, failed: %d, unreachable: %d, timed out: %d, cancelled: %d\n",
+			table, summary.Total, summary.OK, summary.Failed, summary.Unreachable, summary.TimedOut, summary.Cancelled)
+		return err
+	}
+
+	return fmt.Errorf("unsupported output format %q", format)
+}
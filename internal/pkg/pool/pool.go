@@ -0,0 +1,52 @@
+package pool
+
+// Pool bounds the number of hosts worked on concurrently, with a global
+// limit and optional limits per host group. A nil Pool doesn't limit.
+type Pool struct {
+	sem    chan struct{}
+	groups map[string]chan struct{}
+}
+
+// New creates a Pool running at most forks hosts at once, and at most
+// groupForks[g] hosts of group g. Limits less than 1 mean no limit.
+func New(forks int, groupForks map[string]int) *Pool {
+	p := &Pool{
+		groups: map[string]chan struct{}{},
+	}
+	if forks > 0 {
+		p.sem = make(chan struct{}, forks)
+	}
+	for group, n := range groupForks {
+		if n > 0 {
+			p.groups[group] = make(chan struct{}, n)
+		}
+	}
+	return p
+}
+
+// Acquire blocks until a host of group may run and returns the function
+// releasing its slot
+func (p *Pool) Acquire(group string) func() {
+	if p == nil {
+		return func() {}
+	}
+
+	// Take the group slot first so hosts waiting on a busy group don't hold
+	// global slots other groups could use.
+	groupSem := p.groups[group]
+	if groupSem != nil {
+		groupSem <- struct{}{}
+	}
+	if p.sem != nil {
+		p.sem <- struct{}{}
+	}
+
+	return func() {
+		if p.sem != nil {
+			<-p.sem
+		}
+		if groupSem != nil {
+			<-groupSem
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package rsftp
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// sysAtime returns the access time of a local file
+func sysAtime(info fs.FileInfo) (time.Time, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Atim.Sec, st.Atim.Nsec), true
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package rsftp
+
+import (
+	"io/fs"
+	"time"
+)
+
+// sysAtime returns the access time of a local file, it is only read on
+// linux
+func sysAtime(info fs.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
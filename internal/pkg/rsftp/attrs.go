@@ -0,0 +1,237 @@
+package rsftp
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Owner is the user and group transferred files are chowned to, an empty
+// field is left unchanged
+type Owner struct {
+	User  string
+	Group string
+}
+
+// ParseOwner parses 'user', 'user:group' or ':group', names or ids
+func ParseOwner(s string) (*Owner, error) {
+	u, g, _ := strings.Cut(s, ":")
+	if u == "" && g == "" {
+		return nil, fmt.Errorf("invalid owner %q, must be user, user:group or :group", s)
+	}
+	return &Owner{User: u, Group: g}, nil
+}
+
+// ParseMode parses an octal mode such as 0644 or 4755
+func ParseMode(s string) (fs.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 07777 {
+		return 0, fmt.Errorf("invalid mode %q, must be octal such as 0644", s)
+	}
+	mode := fs.FileMode(n) & fs.ModePerm
+	if n&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if n&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if n&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode, nil
+}
+
+// transferredDir is a directory whose attributes are set once its content
+// is transferred, which would change its times
+type transferredDir struct {
+	path string
+	info fs.FileInfo
+}
+
+// ids are a resolved Owner, -1 leaves the id unchanged
+type ids struct {
+	uid int
+	gid int
+}
+
+// remoteOwner resolves opts.Chown with the account files of the server, it
+// returns nil when no owner is set
+func (c *Client) remoteOwner(o *Owner) (*ids, error) {
+	if o == nil || c.remoteIDs != nil {
+		return c.remoteIDs, nil
+	}
+	uid, err := c.lookupID("/etc/passwd", o.User, "user")
+	if err != nil {
+		return nil, err
+	}
+	gid, err := c.lookupID("/etc/group", o.Group, "group")
+	if err != nil {
+		return nil, err
+	}
+	c.remoteIDs = &ids{uid: uid, gid: gid}
+	return c.remoteIDs, nil
+}
+
+// lookupID finds the id of name in a passwd or group file of the server
+func (c *Client) lookupID(file, name, kind string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	f, err := c.Open(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up %s %s, %s", kind, name, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) > 2 && fields[0] == name {
+			return strconv.Atoi(fields[2])
+		}
+	}
+	return 0, fmt.Errorf("%s %s not found on the server", kind, name)
+}
+
+// localOwner resolves opts.Chown with the local accounts, it returns nil
+// when no owner is set
+func (c *Client) localOwner(o *Owner) (*ids, error) {
+	if o == nil || c.localIDs != nil {
+		return c.localIDs, nil
+	}
+	owner := &ids{uid: -1, gid: -1}
+	if o.User != "" {
+		id := o.User
+		if _, err := strconv.Atoi(id); err != nil {
+			u, err := user.Lookup(o.User)
+			if err != nil {
+				return nil, err
+			}
+			id = u.Uid
+		}
+		owner.uid, _ = strconv.Atoi(id)
+	}
+	if o.Group != "" {
+		id := o.Group
+		if _, err := strconv.Atoi(id); err != nil {
+			g, err := user.LookupGroup(o.Group)
+			if err != nil {
+				return nil, err
+			}
+			id = g.Gid
+		}
+		owner.gid, _ = strconv.Atoi(id)
+	}
+	c.localIDs = owner
+	return owner, nil
+}
+
+// wantsAttrs reports whether opts change the attributes of transferred
+// files
+func wantsAttrs(opts TransferOptions) bool {
+	return opts.Preserve || opts.Chmod != 0 || opts.Chown != nil
+}
+
+// modeOf returns the mode to set on a file or directory whose source is
+// info, false to leave it unchanged. Directories get execute bits where
+// --chmod gives read bits, so they stay searchable.
+func modeOf(info fs.FileInfo, opts TransferOptions) (fs.FileMode, bool) {
+	switch {
+	case opts.Chmod != 0 && info.IsDir():
+		return opts.Chmod | (opts.Chmod&0444)>>2, true
+	case opts.Chmod != 0:
+		return opts.Chmod, true
+	case opts.Preserve:
+		return info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky), true
+	}
+	return 0, false
+}
+
+// atime returns the access time of a local or remote file, its
+// modification time when unknown
+func atime(info fs.FileInfo) time.Time {
+	if st, ok := info.Sys().(*sftp.FileStat); ok {
+		return time.Unix(int64(st.Atime), 0)
+	}
+	if t, ok := sysAtime(info); ok {
+		return t
+	}
+	return info.ModTime()
+}
+
+// setRemoteAttrs applies opts to a remote file or directory, info is its
+// local source. The owner goes first, changing it may clear setuid bits.
+func (c *Client) setRemoteAttrs(path string, info fs.FileInfo, opts TransferOptions) error {
+	owner, err := c.remoteOwner(opts.Chown)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		uid, gid := owner.uid, owner.gid
+		if uid < 0 || gid < 0 {
+			// SFTP sets both ids, keep the current one
+			st, err := c.Stat(path)
+			if err != nil {
+				return err
+			}
+			if fst, ok := st.Sys().(*sftp.FileStat); ok {
+				if uid < 0 {
+					uid = int(fst.UID)
+				}
+				if gid < 0 {
+					gid = int(fst.GID)
+				}
+			}
+		}
+		if err := c.Chown(path, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown %s, %s", path, err)
+		}
+	}
+	if mode, ok := modeOf(info, opts); ok {
+		if err := c.Chmod(path, mode); err != nil {
+			return fmt.Errorf("failed to chmod %s, %s", path, err)
+		}
+	}
+	if opts.Preserve {
+		if err := c.Chtimes(path, atime(info), info.ModTime()); err != nil {
+			return fmt.Errorf("failed to set times of %s, %s", path, err)
+		}
+	}
+	return nil
+}
+
+// setLocalAttrs applies opts to a local file or directory, info is its
+// remote source
+func (c *Client) setLocalAttrs(path string, info fs.FileInfo, opts TransferOptions) error {
+	owner, err := c.localOwner(opts.Chown)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		if err := os.Chown(path, owner.uid, owner.gid); err != nil {
+			return err
+		}
+	}
+	if mode, ok := modeOf(info, opts); ok {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if opts.Preserve {
+		if err := os.Chtimes(path, atime(info), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package rsftp
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		s    string
+		want fs.FileMode
+		ok   bool
+	}{
+		{"0644", 0644, true},
+		{"644", 0644, true},
+		{"0", 0, true},
+		{"0777", 0777, true},
+		{"4755", 0755 | fs.ModeSetuid, true},
+		{"2755", 0755 | fs.ModeSetgid, true},
+		{"1777", 0777 | fs.ModeSticky, true},
+		{"7777", 0777 | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky, true},
+		{"07777", 0777 | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky, true},
+		{"10000", 0, false},
+		{"0648", 0, false},
+		{"rw-r--r--", 0, false},
+		{"u+x", 0, false},
+		{"-644", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseMode(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseMode(%q) = %s, %v, want %s, ok %v", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	tests := []struct {
+		s    string
+		want *Owner
+	}{
+		{"app", &Owner{User: "app"}},
+		{"app:web", &Owner{User: "app", Group: "web"}},
+		{":web", &Owner{Group: "web"}},
+		{"app:", &Owner{User: "app"}},
+		{"1000:1000", &Owner{User: "1000", Group: "1000"}},
+		{"", nil},
+		{":", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseOwner(tt.s)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseOwner(%q) = %+v, want an error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseOwner(%q) = %+v, %v, want %+v", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+// fileInfo is a fs.FileInfo of a given mode
+type fileInfo struct {
+	fs.FileInfo
+	mode fs.FileMode
+}
+
+func (fi fileInfo) Mode() fs.FileMode { return fi.mode }
+func (fi fileInfo) IsDir() bool       { return fi.mode.IsDir() }
+
+func TestModeOf(t *testing.T) {
+	file := fileInfo{mode: 0640 | fs.ModeSetgid}
+	dir := fileInfo{mode: fs.ModeDir | 0750}
+	tests := []struct {
+		info fs.FileInfo
+		opts TransferOptions
+		want fs.FileMode
+		ok   bool
+	}{
+		{file, TransferOptions{}, 0, false},
+		{file, TransferOptions{Preserve: true}, 0640 | fs.ModeSetgid, true},
+		{dir, TransferOptions{Preserve: true}, 0750, true},
+		{file, TransferOptions{Chmod: 0644}, 0644, true},
+		{file, TransferOptions{Chmod: 0644, Preserve: true}, 0644, true},
+		{dir, TransferOptions{Chmod: 0644}, 0755, true},
+		{dir, TransferOptions{Chmod: 0640}, 0750, true},
+		{dir, TransferOptions{Chmod: 0600}, 0700, true},
+	}
+	for _, tt := range tests {
+		got, ok := modeOf(tt.info, tt.opts)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("modeOf(%s, %+v) = %s, %v, want %s, %v", tt.info.Mode(), tt.opts, got, ok, tt.want, tt.ok)
+		}
+	}
+}
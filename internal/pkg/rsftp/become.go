@@ -0,0 +1,106 @@
+package rsftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sshtools/internal/pkg/become"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpServerPaths are the usual locations of the OpenSSH SFTP server
+var sftpServerPaths = []string{
+	"/usr/lib/openssh/sftp-server",
+	"/usr/libexec/openssh/sftp-server",
+	"/usr/lib/ssh/sftp-server",
+	"/usr/libexec/sftp-server",
+	"/usr/lib/sftp-server",
+}
+
+// newBecomeClient starts an SFTP server as the become user and talks to it
+// over the session's stdin and stdout, so files are read and written with
+// that user's permissions
+func newBecomeClient(conn *ssh.Client, addr string, b *become.Become) (*Client, error) {
+	if err := checkBecome(b); err != nil {
+		return nil, err
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session, %s", err)
+	}
+
+	outR, outW := io.Pipe()
+	inR, inW := io.Pipe()
+	var stderr bytes.Buffer
+	proc, err := b.Start(session, sftpServerCommand(), inR, outW, &stderr)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	go func() {
+		err := session.Wait()
+		if becomeErr := proc.Err(); becomeErr != nil {
+			err = becomeErr
+		} else if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		outW.CloseWithError(err)
+		// Unblock the client if it is still sending its first request
+		inR.CloseWithError(err)
+	}()
+
+	sftpClient, err := sftp.NewClientPipe(outR, inW, clientOptions...)
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to create SFTP client as %s, %s", b.TargetUser(), err)
+	}
+
+	c := &Client{
+		Client: sftpClient,
+		conn:   conn,
+		Addr:   addr,
+	}
+	return c, nil
+}
+
+// newBecome returns how cfg becomes another user, nil if it doesn't
+func newBecome(cfg ClientConfig) *become.Become {
+	if cfg.Become == nil || !*cfg.Become {
+		return nil
+	}
+	return &become.Become{
+		Method:   cfg.BecomeMethod,
+		User:     cfg.BecomeUser,
+		Password: cfg.BecomePassword,
+		Pty:      cfg.BecomePty != nil && *cfg.BecomePty,
+	}
+}
+
+// CheckBecome returns an error if cfg becomes another user in a way file
+// transfers don't support, the SFTP protocol can't pass through a terminal
+func CheckBecome(cfg ClientConfig) error {
+	if b := newBecome(cfg); b != nil {
+		return checkBecome(b)
+	}
+	return nil
+}
+
+func checkBecome(b *become.Become) error {
+	if b.NeedsPty() {
+		return fmt.Errorf("file transfers can't run %s on a terminal, they only support %s without --become-pty", b.Method, become.MethodSudo)
+	}
+	return nil
+}
+
+func sftpServerCommand() string {
+	return fmt.Sprintf(`for p in %s; do if [ -x "$p" ]; then exec "$p"; fi; done; echo "sftp-server not found" >&2; exit 127`,
+		strings.Join(sftpServerPaths, " "))
+}
@@ -0,0 +1,171 @@
+package rsftp
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sshtools/internal/pkg/shell"
+	"strings"
+)
+
+// Checksum algorithms to verify transferred files with
+const (
+	SHA256 = "sha256"
+	MD5    = "md5"
+)
+
+// ChecksumAlgorithms lists the accepted checksum algorithms
+var ChecksumAlgorithms = []string{SHA256, MD5}
+
+// errChecksumMismatch is returned for a transferred file whose checksum
+// differs from its source
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// hashes maps the checksum algorithms to their hash and the command which
+// computes it on the server
+var hashes = map[string]struct {
+	new     func() hash.Hash
+	command string
+}{
+	SHA256: {sha256.New, "sha256sum"},
+	MD5:    {md5.New, "md5sum"},
+}
+
+// ValidateChecksum returns an error if algo is not a known checksum
+// algorithm
+func ValidateChecksum(algo string) error {
+	if _, ok := hashes[algo]; !ok {
+		return fmt.Errorf("invalid checksum algorithm %q, must be one of %s", algo, strings.Join(ChecksumAlgorithms, ","))
+	}
+	return nil
+}
+
+// hashReader hashes what is read through it. Size lets the SFTP client
+// still write the file with concurrent requests.
+type hashReader struct {
+	r    io.Reader
+	h    hash.Hash
+	size int64
+}
+
+func (r *hashReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.h.Write(b[:n])
+	return n, err
+}
+
+func (r *hashReader) Size() int64 {
+	return r.size
+}
+
+// hashLocal returns the hex checksum of a local file
+func hashLocal(path, algo string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := hashes[algo].new()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to checksum %s, %s", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashRemote returns the hex checksum of a remote file. It is computed on
+// the server when it has a shell and the command, otherwise the file is
+// read back over SFTP.
+func (c *Client) hashRemote(ctx context.Context, path, algo string) (string, error) {
+	if sum, err := c.execHash(ctx, path, algo); err == nil {
+		return sum, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	f, err := c.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := hashes[algo].new()
+	if _, err := f.WriteTo(h); err != nil {
+		return "", fmt.Errorf("failed to checksum remote %s, %s", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// execHash runs the checksum command of algo on the server
+func (c *Client) execHash(ctx context.Context, path, algo string) (string, error) {
+	if c.conn == nil {
+		return "", fmt.Errorf("no ssh connection")
+	}
+	session, err := c.conn.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	out, err := session.Output(hashes[algo].command + " -- " + shell.Quote(path))
+	if err != nil {
+		return "", err
+	}
+	// Names with a backslash or newline get a leading backslash
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("unexpected %s output", hashes[algo].command)
+	}
+	return strings.TrimPrefix(fields[0], "\\"), nil
+}
+
+// verify compares the checksums of a local and a remote file
+func (c *Client) verify(ctx context.Context, localFile, remoteFile, algo string) error {
+	local, err := hashLocal(localFile, algo)
+	if err != nil {
+		return err
+	}
+	return c.compare(ctx, local, remoteFile, algo)
+}
+
+// compare checks the checksum of a remote file against local
+func (c *Client) compare(ctx context.Context, local, remoteFile, algo string) error {
+	remote, err := c.hashRemote(ctx, remoteFile, algo)
+	if err != nil {
+		return err
+	}
+	if local != remote {
+		return fmt.Errorf("%w of %s", errChecksumMismatch, remoteFile)
+	}
+	return nil
+}
+
+// mismatchError reports the files of a host that failed verification
+func mismatchError(files []string, opts TransferOptions) error {
+	algo := opts.Verify
+	if algo == "" {
+		algo = SHA256
+	}
+	msg := fmt.Sprintf("%s %s of %d files: %s", algo, errChecksumMismatch, len(files), strings.Join(files, ", "))
+	if opts.Resume {
+		msg += ", transfer them again with --force instead of --resume"
+	}
+	return errors.New(msg)
+}
@@ -1,45 +1,64 @@
 package rsftp
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
+	"sshtools/internal/pkg/pool"
+	"sshtools/internal/pkg/sshconn"
 	"sync"
+	"time"
 )
 
 type MultiClient struct {
 	clients []*Client
+	dialer  *sshconn.Dialer
+	pool    *pool.Pool
 }
 
-func NewMultiClient(cfgs []ClientConfig) (*MultiClient, error) {
+// NewMultiClient connects to the servers concurrently, as many at once as p
+// allows, which also bounds every later operation on them. Servers that
+// can't be connected don't stop the others, they are returned as failed
+// responses.
+func NewMultiClient(ctx context.Context, cfgs []ClientConfig, p *pool.Pool) (*MultiClient, []Response) {
 	clients := []*Client{}
+	dialer := sshconn.NewDialer()
 
 	clientChan := make(chan *Client, len(cfgs))
-	errChan := make(chan error, len(cfgs))
+	failChan := make(chan Response, len(cfgs))
 	var wg sync.WaitGroup
 	for _, config := range cfgs {
 		wg.Add(1)
 		cfg := config
 		go func() {
 			defer wg.Done()
-			newClientWithChannel(cfg, clientChan, errChan)
+			defer p.Acquire(cfg.Group)()
+			newClientWithChannel(ctx, cfg, dialer, clientChan, failChan)
 		}()
 	}
 	wg.Wait()
 	close(clientChan)
-	close(errChan)
+	close(failChan)
 
 	for c := range clientChan {
 		clients = append(clients, c)
 	}
 
+	failed := []Response{}
+	for resp := range failChan {
+		failed = append(failed, resp)
+	}
+
 	mc := &MultiClient{
 		clients: clients,
+		dialer:  dialer,
+		pool:    p,
 	}
 
-	return mc, nil
+	return mc, failed
 }
 
-func (mc *MultiClient) UploadFiles(localPath, remotePath string, force bool) []Response {
+func (mc *MultiClient) UploadFiles(ctx context.Context, localPath, remotePath string, opts TransferOptions) []Response {
 	var wg sync.WaitGroup
 
 	respChan := make(chan Response, len(mc.clients))
@@ -48,7 +67,10 @@ func (mc *MultiClient) UploadFiles(localPath, remotePath string, force bool) []R
 		c := client
 		go func() {
 			defer wg.Done()
-			c.UploadFiles(localPath, remotePath, force, respChan)
+			defer mc.pool.Acquire(c.Group)()
+			ctx, cancel := withTimeout(ctx, opts.Timeout)
+			defer cancel()
+			c.UploadFiles(ctx, localPath, remotePath, opts, respChan)
 		}()
 	}
 	wg.Wait()
@@ -62,7 +84,33 @@ func (mc *MultiClient) UploadFiles(localPath, remotePath string, force bool) []R
 	return resps
 }
 
-func (mc *MultiClient) DownloadFiles(localPath, remotePath string) []Response {
+func (mc *MultiClient) SyncFiles(ctx context.Context, localPath, remotePath string, opts TransferOptions) []Response {
+	var wg sync.WaitGroup
+
+	respChan := make(chan Response, len(mc.clients))
+	for _, client := range mc.clients {
+		wg.Add(1)
+		c := client
+		go func() {
+			defer wg.Done()
+			defer mc.pool.Acquire(c.Group)()
+			ctx, cancel := withTimeout(ctx, opts.Timeout)
+			defer cancel()
+			c.SyncFiles(ctx, localPath, remotePath, opts, respChan)
+		}()
+	}
+	wg.Wait()
+	close(respChan)
+
+	resps := []Response{}
+	for resp := range respChan {
+		resps = append(resps, resp)
+	}
+
+	return resps
+}
+
+func (mc *MultiClient) DownloadFiles(ctx context.Context, localPath, remotePath string, opts TransferOptions) []Response {
 	var wg sync.WaitGroup
 
 	respChan := make(chan Response, len(mc.clients))
@@ -72,7 +120,10 @@ func (mc *MultiClient) DownloadFiles(localPath, remotePath string) []Response {
 		lp := filepath.Join(localPath, c.Addr)
 		go func() {
 			defer wg.Done()
-			c.DownloadFiles(lp, remotePath, respChan)
+			defer mc.pool.Acquire(c.Group)()
+			ctx, cancel := withTimeout(ctx, opts.Timeout)
+			defer cancel()
+			c.DownloadFiles(ctx, lp, remotePath, opts, respChan)
 		}()
 	}
 	wg.Wait()
@@ -86,6 +137,14 @@ func (mc *MultiClient) DownloadFiles(localPath, remotePath string) []Response {
 	return resps
 }
 
+// withTimeout bounds ctx by timeout unless it is 0
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 func (mc *MultiClient) Close() error {
 	var err error
 	for _, c := range mc.clients {
@@ -93,5 +152,8 @@ func (mc *MultiClient) Close() error {
 			err = fmt.Errorf("%s; %s close failed, %s", err, c.Addr, e)
 		}
 	}
+	if e := mc.dialer.Close(); e != nil {
+		err = fmt.Errorf("%s; %s", err, e)
+	}
 	return err
 }
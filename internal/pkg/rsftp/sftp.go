@@ -1,130 +1,234 @@
 package rsftp
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/fs"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sshtools/internal/pkg/sshconn"
 	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
-type ClientConfig struct {
-	Addr           string `json:"addr" mapstructure:"addr"`
-	Username       string `json:"username" mapstructure:"username"`
-	Password       string `json:"password" mapstructure:"password"`
-	PrivateKeyPath string `json:"privateKeyPath" mapstructure:"privateKeyPath"`
-}
+type ClientConfig = sshconn.Config
 
 type Response struct {
 	Addr      string
 	Output    string
 	Err       error
 	FileInfos []fs.FileInfo
+	// Bytes is the number of bytes transferred, including those of a
+	// transfer that failed halfway
+	Bytes    int64
+	Duration time.Duration
+	// Attempts is the number of connection attempts made to the host
+	Attempts int
+}
+
+// TransferOptions controls how files are transferred
+type TransferOptions struct {
+	// Force overwrites remote files that already exist on upload
+	Force bool
+	// Resume continues files partially transferred before, they are
+	// verified with a checksum once complete
+	Resume bool
+	// Verify is the checksum algorithm every transferred file is verified
+	// with, none when empty. Resumed files use sha256 by default.
+	Verify string
+	// Preserve keeps the mode and times of the source files and directories
+	Preserve bool
+	// Chmod sets the mode of transferred files, directories get execute
+	// bits where it has read bits. 0 leaves the mode unchanged.
+	Chmod fs.FileMode
+	// Chown sets the owner of transferred files and directories
+	Chown *Owner
+	// Checksum makes SyncFiles compare files by checksum instead of size
+	// and modification time
+	Checksum bool
+	// Delete makes SyncFiles remove remote files missing locally
+	Delete bool
+	// Timeout bounds the time spent on each host, 0 means no limit
+	Timeout time.Duration
+}
+
+// maxConcurrentRequests bounds the requests in flight for a file, and with
+// them the memory a transfer takes, to 32 packets of 32KB per host
+const maxConcurrentRequests = 32
+
+// clientOptions streams files with concurrent requests in both directions
+var clientOptions = []sftp.ClientOption{
+	sftp.UseConcurrentWrites(true),
+	sftp.MaxConcurrentRequestsPerFile(maxConcurrentRequests),
 }
 
 type Client struct {
 	*sftp.Client
-
-	Addr string
+	// conn runs the checksum commands, it is nil when the client is built
+	// without one
+	conn *ssh.Client
+	// remoteIDs and localIDs are the resolved Chown of the transfers
+	remoteIDs *ids
+	localIDs  *ids
+
+	Addr     string
+	Group    string
+	Attempts int
 }
 
 func NewClient(conn *ssh.Client, addr string) (*Client, error) {
-	sftpClient, err := sftp.NewClient(conn)
+	sftpClient, err := sftp.NewClient(conn, clientOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SFTP client, %s", err)
 	}
 
 	c := &Client{
 		Client: sftpClient,
+		conn:   conn,
 		Addr:   addr,
 	}
 	return c, nil
 }
 
-func NewForConfig(cfg ClientConfig) (*Client, error) {
-	sshConfig := &ssh.ClientConfig{
-		User:            cfg.Username,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         time.Second * 2,
+func NewForConfig(ctx context.Context, cfg ClientConfig, dialer *sshconn.Dialer) (*Client, error) {
+	sshClient, attempts, err := dialer.Dial(ctx, cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	if cfg.Password != "" {
-		sshConfig.Auth = []ssh.AuthMethod{
-			ssh.Password(cfg.Password),
-		}
-	} else if cfg.PrivateKeyPath != "" {
-		pemBytes, err := os.ReadFile(cfg.PrivateKeyPath)
-		if err != nil {
-			return nil, err
-		}
-		singner, err := ssh.ParsePrivateKey(pemBytes)
-		if err != nil {
-			return nil, err
-		}
-		sshConfig.Auth = []ssh.AuthMethod{
-			ssh.PublicKeys(singner),
-		}
+	var c *Client
+	if b := newBecome(cfg); b != nil {
+		c, err = newBecomeClient(sshClient, cfg.Addr, b)
 	} else {
-		return nil, errors.New("Provide the password or privateKeyPath.")
+		c, err = NewClient(sshClient, cfg.Addr)
 	}
-
-	sshClient, err := ssh.Dial("tcp", cfg.Addr, sshConfig)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect %s, %s", cfg.Addr, err)
+		sshClient.Close()
+		return nil, err
 	}
-
-	return NewClient(sshClient, cfg.Addr)
+	c.Group = cfg.Group
+	c.Attempts = attempts
+	return c, nil
 }
 
 func (c *Client) ListFiles(remotePath string) ([]Response, error) {
 	return nil, nil
 }
 
-// UploadFile upload file from local to remote SSH server
-func (c *Client) UploadFile(localFile, remoteFile string, force bool) error {
+// UploadFile upload file from local to remote SSH server, it returns the
+// number of bytes written
+func (c *Client) UploadFile(ctx context.Context, localFile, remoteFile string, opts TransferOptions) (int64, error) {
 	localInfo, err := os.Stat(localFile)
 	if err != nil {
-		return fmt.Errorf("local %s file is not exist, %s", localFile, err)
+		return 0, fmt.Errorf("local %s file is not exist, %s", localFile, err)
 	}
 
 	if localInfo.IsDir() {
-		return fmt.Errorf("%s is directory, require a file", localFile)
+		return 0, fmt.Errorf("%s is directory, require a file", localFile)
 	}
 
-	if _, err := c.Stat(remoteFile); err == nil && !force {
-		return fmt.Errorf("remote file %s already exists", remoteFile)
+	// offset is the size of a partial upload to continue
+	var offset int64
+	remoteInfo, err := c.Stat(remoteFile)
+	switch {
+	case err != nil:
+	case opts.Resume && !remoteInfo.IsDir() && remoteInfo.Size() <= localInfo.Size():
+		offset = remoteInfo.Size()
+	case opts.Resume && !opts.Force:
+		return 0, fmt.Errorf("remote file %s exists and is larger than the source or not a file, it can't be resumed", remoteFile)
+	case !opts.Force:
+		return 0, fmt.Errorf("remote file %s already exists", remoteFile)
 	}
 
 	if err := c.MkdirAll(filepath.Dir(remoteFile)); err != nil {
-		return err
+		return 0, err
 	}
 
-	content, err := os.ReadFile(localFile)
+	lf, err := os.Open(localFile)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer lf.Close()
 
-	f, err := c.Create(remoteFile)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY
+	}
+	rf, err := c.OpenFile(remoteFile, flags)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if _, err := lf.Seek(offset, io.SeekStart); err != nil {
+		rf.Close()
+		return 0, err
+	}
+	rf.Seek(offset, io.SeekStart)
+
+	var h hash.Hash
+	var r io.Reader = lf
+	if algo := verifyAlgo(opts); algo != "" && offset == 0 {
+		h = hashes[algo].new()
+		r = &hashReader{r: lf, h: h, size: localInfo.Size()}
 	}
-	_, err = f.Write(content)
 
-	return err
+	// ReadFrom is called directly, io.Copy would hide the size of the local
+	// file from it and write one packet at a time
+	n, err := rf.ReadFrom(r)
+	if err != nil {
+		// Concurrent writes may have gone past the first failed one, cut the
+		// file to the length known to be written
+		if off, serr := rf.Seek(0, io.SeekCurrent); serr == nil {
+			rf.Truncate(off)
+			n = off - offset
+		}
+		rf.Close()
+		return n, err
+	}
+	if err := rf.Close(); err != nil {
+		return n, err
+	}
+
+	if err := c.verifyTransfer(ctx, localFile, remoteFile, h, opts); err != nil {
+		return n, err
+	}
+	if wantsAttrs(opts) {
+		return n, c.setRemoteAttrs(remoteFile, localInfo, opts)
+	}
+	return n, nil
 }
 
 // UploadFiles upload file or directory from local to remote SSH server
-func (c *Client) UploadFiles(localPath, remotePath string, force bool, ch chan<- Response) {
+func (c *Client) UploadFiles(ctx context.Context, localPath, remotePath string, opts TransferOptions, ch chan<- Response) {
+	start := time.Now()
+	var written int64
+	// mismatched are the files which failed verification
+	var mismatched []string
+	defer c.watch(ctx)()
+
 	if _, err := os.Stat(localPath); err != nil {
 		ch <- Response{
-			Addr:   c.Addr,
-			Output: "",
-			Err:    fmt.Errorf("local %s is not exist, %s", localPath, err),
+			Addr:     c.Addr,
+			Attempts: c.Attempts,
+			Output:   "",
+			Err:      fmt.Errorf("local %s is not exist, %s", localPath, err),
+			Duration: time.Since(start),
+		}
+		return
+	}
+
+	if _, err := c.remoteOwner(opts.Chown); err != nil {
+		ch <- Response{
+			Addr:     c.Addr,
+			Attempts: c.Attempts,
+			Output:   "",
+			Err:      err,
+			Duration: time.Since(start),
 		}
 		return
 	}
@@ -134,99 +238,222 @@ func (c *Client) UploadFiles(localPath, remotePath string, force bool, ch chan<-
 		remotePath = filepath.Join(remotePath, filepath.Base(localPath))
 	}
 
+	var dirs []transferredDir
 	err = filepath.Walk(localPath, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		if info.IsDir() {
 			remoteDir := filepath.Join(remotePath, path[len(localPath):])
 			if err := c.MkdirAll(remoteDir); err != nil {
 				return err
 			}
+			if wantsAttrs(opts) {
+				dirs = append(dirs, transferredDir{path: remoteDir, info: info})
+			}
 			return nil
 		}
 
 		remoteFile := filepath.Join(remotePath, path[len(localPath):])
-		return c.UploadFile(path, remoteFile, force)
+		n, err := c.UploadFile(ctx, path, remoteFile, opts)
+		written += n
+		if errors.Is(err, errChecksumMismatch) {
+			mismatched = append(mismatched, remoteFile)
+			return nil
+		}
+		return err
 	})
+	// Deeper directories go first, their times change with their content
+	for i := len(dirs) - 1; i >= 0 && err == nil; i-- {
+		err = c.setRemoteAttrs(dirs[i].path, dirs[i].info, opts)
+	}
+	if err == nil && len(mismatched) > 0 {
+		err = mismatchError(mismatched, opts)
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = cancelError(ctxErr)
+	}
 
 	if err != nil {
 		ch <- Response{
-			Addr:   c.Addr,
-			Output: "",
-			Err:    err,
+			Addr:     c.Addr,
+			Attempts: c.Attempts,
+			Output:   "",
+			Err:      err,
+			Bytes:    written,
+			Duration: time.Since(start),
 		}
 		return
 	}
 
 	ch <- Response{
-		Addr:   c.Addr,
-		Output: fmt.Sprintf("%s -> %s:%s", localPath, c.Addr, remotePath),
-		Err:    nil,
+		Addr:     c.Addr,
+		Attempts: c.Attempts,
+		Output:   fmt.Sprintf("%s -> %s:%s", localPath, c.Addr, remotePath),
+		Err:      nil,
+		Bytes:    written,
+		Duration: time.Since(start),
 	}
 }
 
-// DownloadFile download file from remote SSH server to local
-func (c *Client) DownloadFile(localFile, remoteFile string) error {
+// DownloadFile download file from remote SSH server to local, it returns
+// the number of bytes written
+func (c *Client) DownloadFile(ctx context.Context, localFile, remoteFile string, opts TransferOptions) (int64, error) {
 	remoteInfo, err := c.Stat(remoteFile)
 	if err != nil {
-		return fmt.Errorf("remote file %s is not exist, %s", remoteFile, err)
+		return 0, fmt.Errorf("remote file %s is not exist, %s", remoteFile, err)
 	}
 
 	if remoteInfo.IsDir() {
-		return fmt.Errorf("%s is directory, require a file", remoteFile)
+		return 0, fmt.Errorf("%s is directory, require a file", remoteFile)
 	}
 
-	if _, err := os.Stat(localFile); err == nil {
-		return fmt.Errorf("local file %s already exists", localFile)
+	// offset is the size of a partial download to continue
+	var offset int64
+	localInfo, err := os.Stat(localFile)
+	switch {
+	case err != nil:
+	case opts.Resume && !localInfo.IsDir() && localInfo.Size() <= remoteInfo.Size():
+		offset = localInfo.Size()
+	case opts.Resume && !opts.Force:
+		return 0, fmt.Errorf("local file %s exists and is larger than the source or not a file, it can't be resumed", localFile)
+	case !opts.Force:
+		return 0, fmt.Errorf("local file %s already exists", localFile)
 	}
 
 	if err := os.MkdirAll(filepath.Dir(localFile), 0755); err != nil {
-		return err
+		return 0, err
 	}
 
 	rf, err := c.Open(remoteFile)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	content, err := ioutil.ReadAll(rf)
+	defer rf.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY
+	}
+	lf, err := os.OpenFile(localFile, flags, 0644)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if _, err := lf.Seek(offset, io.SeekStart); err != nil {
+		lf.Close()
+		return 0, err
+	}
+	rf.Seek(offset, io.SeekStart)
+
+	var h hash.Hash
+	var w io.Writer = lf
+	if algo := verifyAlgo(opts); algo != "" && offset == 0 {
+		h = hashes[algo].new()
+		w = io.MultiWriter(lf, h)
 	}
 
-	lf, err := os.Create(localFile)
+	n, err := io.Copy(w, rf)
 	if err != nil {
-		return err
+		lf.Close()
+		return n, err
+	}
+	if err := lf.Close(); err != nil {
+		return n, err
 	}
-	_, err = lf.Write(content)
 
-	return err
+	if err := c.verifyTransfer(ctx, localFile, remoteFile, h, opts); err != nil {
+		return n, err
+	}
+	if wantsAttrs(opts) {
+		return n, c.setLocalAttrs(localFile, remoteInfo, opts)
+	}
+	return n, nil
+}
+
+// verifyAlgo returns the checksum algorithm transferred files are verified
+// with, sha256 for --resume unless --verify says otherwise, none when empty
+func verifyAlgo(opts TransferOptions) string {
+	if opts.Verify == "" && opts.Resume {
+		return SHA256
+	}
+	return opts.Verify
+}
+
+// verifyTransfer checks a transferred file with verifyAlgo. h is the hash of
+// the data streamed, nil when the file was resumed and is hashed whole.
+func (c *Client) verifyTransfer(ctx context.Context, localFile, remoteFile string, h hash.Hash, opts TransferOptions) error {
+	algo := verifyAlgo(opts)
+	switch {
+	case algo == "":
+		return nil
+	case h != nil:
+		return c.compare(ctx, hex.EncodeToString(h.Sum(nil)), remoteFile, algo)
+	}
+	return c.verify(ctx, localFile, remoteFile, algo)
 }
 
 // DownloadFiles download file or directory from remote SSH server to local
-func (c *Client) DownloadFiles(localPath, remotePath string, ch chan<- Response) {
+func (c *Client) DownloadFiles(ctx context.Context, localPath, remotePath string, opts TransferOptions, ch chan<- Response) {
+	start := time.Now()
+	var written int64
+	// mismatched are the files which failed verification
+	var mismatched []string
+	defer c.watch(ctx)()
+
 	if _, err := c.Stat(remotePath); err != nil {
 		ch <- Response{
-			Addr:   c.Addr,
-			Output: "",
-			Err:    fmt.Errorf("remote path %s is not exist, %s", remotePath, err),
+			Addr:     c.Addr,
+			Attempts: c.Attempts,
+			Output:   "",
+			Err:      fmt.Errorf("remote path %s is not exist, %s", remotePath, err),
+			Duration: time.Since(start),
 		}
 		return
 	}
 
-	localInfo, err := c.Stat(localPath)
+	if _, err := c.localOwner(opts.Chown); err != nil {
+		ch <- Response{
+			Addr:     c.Addr,
+			Attempts: c.Attempts,
+			Output:   "",
+			Err:      err,
+			Duration: time.Since(start),
+		}
+		return
+	}
+
+	localInfo, err := os.Stat(localPath)
 	if err == nil && localInfo.IsDir() {
 		localPath = filepath.Join(localPath, filepath.Base(remotePath))
 	}
 
+	var dirs []transferredDir
+
 	w := c.Walk(remotePath)
 	for w.Step() {
-		if w.Err() != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
 			ch <- Response{
-				Addr:   c.Addr,
-				Output: "",
-				Err:    err,
+				Addr:     c.Addr,
+				Attempts: c.Attempts,
+				Output:   "",
+				Err:      cancelError(ctxErr),
+				Bytes:    written,
+				Duration: time.Since(start),
+			}
+			return
+		}
+		if err := w.Err(); err != nil {
+			ch <- Response{
+				Addr:     c.Addr,
+				Attempts: c.Attempts,
+				Output:   "",
+				Err:      err,
+				Bytes:    written,
+				Duration: time.Since(start),
 			}
 			return
 		}
@@ -236,37 +463,129 @@ func (c *Client) DownloadFiles(localPath, remotePath string, ch chan<- Response)
 			localDir := filepath.Join(localPath, path[len(remotePath):])
 			if err := os.MkdirAll(localDir, w.Stat().Mode()); err != nil {
 				ch <- Response{
-					Addr:   c.Addr,
-					Output: "",
-					Err:    err,
+					Addr:     c.Addr,
+					Attempts: c.Attempts,
+					Output:   "",
+					Err:      err,
+					Bytes:    written,
+					Duration: time.Since(start),
 				}
 				return
 			}
+			if wantsAttrs(opts) {
+				dirs = append(dirs, transferredDir{path: localDir, info: w.Stat()})
+			}
 			continue
 		}
 
 		localFile := filepath.Join(localPath, path[len(remotePath):])
-		if err := c.DownloadFile(localFile, path); err != nil {
+		n, err := c.DownloadFile(ctx, localFile, path, opts)
+		written += n
+		if errors.Is(err, errChecksumMismatch) {
+			mismatched = append(mismatched, path)
+			err = nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = cancelError(ctxErr)
+		}
+		if err != nil {
 			ch <- Response{
-				Addr:   c.Addr,
-				Output: "",
-				Err:    err,
+				Addr:     c.Addr,
+				Attempts: c.Attempts,
+				Output:   "",
+				Err:      err,
+				Bytes:    written,
+				Duration: time.Since(start),
 			}
 			return
 		}
 	}
 
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := c.setLocalAttrs(dirs[i].path, dirs[i].info, opts); err != nil {
+			ch <- Response{
+				Addr:     c.Addr,
+				Attempts: c.Attempts,
+				Output:   "",
+				Err:      err,
+				Bytes:    written,
+				Duration: time.Since(start),
+			}
+			return
+		}
+	}
+
+	if len(mismatched) > 0 {
+		ch <- Response{
+			Addr:     c.Addr,
+			Attempts: c.Attempts,
+			Output:   "",
+			Err:      mismatchError(mismatched, opts),
+			Bytes:    written,
+			Duration: time.Since(start),
+		}
+		return
+	}
+
 	ch <- Response{
-		Addr:   c.Addr,
-		Output: fmt.Sprintf("%s:%s -> %s", c.Addr, remotePath, localPath),
-		Err:    nil,
+		Addr:     c.Addr,
+		Attempts: c.Attempts,
+		Output:   fmt.Sprintf("%s:%s -> %s", c.Addr, remotePath, localPath),
+		Err:      nil,
+		Bytes:    written,
+		Duration: time.Since(start),
 	}
 }
 
-func newClientWithChannel(cfg ClientConfig, ch chan<- *Client, errch chan<- error) {
-	client, err := NewForConfig(cfg)
-	errch <- err
+// watch closes the SFTP session when ctx is done, aborting the transfer in
+// progress. The returned function stops watching.
+func (c *Client) watch(ctx context.Context) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Client.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// cancelError reports a transfer stopped because its context is done
+func cancelError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("transfer timed out, %w", err)
+	}
+	return fmt.Errorf("transfer cancelled, %w", err)
+}
+
+func newClientWithChannel(ctx context.Context, cfg ClientConfig, dialer *sshconn.Dialer, ch chan<- *Client, failch chan<- Response) {
+	start := time.Now()
+	if err := ctx.Err(); err != nil {
+		failch <- Response{
+			Addr:     cfg.Addr,
+			Err:      fmt.Errorf("connection cancelled, %w", err),
+			Duration: time.Since(start),
+		}
+		return
+	}
+
+	client, err := NewForConfig(ctx, cfg, dialer)
 	if err != nil {
+		var connErr *sshconn.ConnectError
+		if !errors.As(err, &connErr) {
+			connErr = &sshconn.ConnectError{Addr: cfg.Addr, Attempts: 1, Err: err}
+			err = connErr
+		}
+		failch <- Response{
+			Addr:     cfg.Addr,
+			Output:   "",
+			Err:      err,
+			Duration: time.Since(start),
+			Attempts: connErr.Attempts,
+		}
 		return
 	}
 	ch <- client
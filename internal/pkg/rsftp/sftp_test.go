@@ -0,0 +1,101 @@
+package rsftp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// newTestClient returns a client of an SFTP server serving the local
+// filesystem in process, checksums are read back over SFTP
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn, clientOptions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return &Client{Client: client, Addr: "test"}
+}
+
+func TestTransferFile(t *testing.T) {
+	const source = "0123456789abcdef"
+	tests := []struct {
+		name   string
+		target string
+		exists bool
+		opts   TransferOptions
+		want   string
+		err    string
+	}{
+		{name: "new", opts: TransferOptions{}, want: source},
+		{name: "exists", target: "old", exists: true, opts: TransferOptions{}, want: "old", err: "already exists"},
+		{name: "force", target: "old content longer than the source", exists: true, opts: TransferOptions{Force: true}, want: source},
+		{name: "resume new", opts: TransferOptions{Resume: true}, want: source},
+		{name: "resume partial", target: "0123", exists: true, opts: TransferOptions{Resume: true}, want: source},
+		{name: "resume complete", target: source, exists: true, opts: TransferOptions{Resume: true}, want: source},
+		{name: "resume empty", target: "", exists: true, opts: TransferOptions{Resume: true}, want: source},
+		{name: "resume larger", target: source + "more", exists: true, opts: TransferOptions{Resume: true}, want: source + "more", err: "larger than the source"},
+		{name: "resume different prefix", target: "xxxx", exists: true, opts: TransferOptions{Resume: true}, want: "xxxx456789abcdef", err: errChecksumMismatch.Error()},
+		{name: "verify", opts: TransferOptions{Verify: MD5}, want: source},
+	}
+
+	c := newTestClient(t)
+	directions := map[string]func(ctx context.Context, src, dst string, opts TransferOptions) (int64, error){
+		"upload": func(ctx context.Context, src, dst string, opts TransferOptions) (int64, error) {
+			return c.UploadFile(ctx, src, dst, opts)
+		},
+		"download": func(ctx context.Context, src, dst string, opts TransferOptions) (int64, error) {
+			return c.DownloadFile(ctx, dst, src, opts)
+		},
+	}
+	for direction, transfer := range directions {
+		for _, tt := range tests {
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+			if err := os.WriteFile(src, []byte(source), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.exists {
+				if err := os.WriteFile(dst, []byte(tt.target), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := transfer(context.Background(), src, dst, tt.opts)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("%s %s: error %s", direction, tt.name, err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("%s %s: error %v, want %q", direction, tt.name, err, tt.err)
+			}
+			if tt.err == errChecksumMismatch.Error() && !errors.Is(err, errChecksumMismatch) {
+				t.Errorf("%s %s: error %v is not a checksum mismatch", direction, tt.name, err)
+			}
+
+			b, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("%s %s: target %q, want %q", direction, tt.name, b, tt.want)
+			}
+		}
+	}
+}
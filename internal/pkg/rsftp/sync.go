@@ -0,0 +1,304 @@
+package rsftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SyncStats counts the files of a sync by what was done to them
+type SyncStats struct {
+	Created   int
+	Updated   int
+	Deleted   int
+	Unchanged int
+}
+
+func (s SyncStats) String() string {
+	return fmt.Sprintf("created %d, updated %d, deleted %d, unchanged %d", s.Created, s.Updated, s.Deleted, s.Unchanged)
+}
+
+// SyncFiles makes remotePath a copy of localPath, only the files whose size
+// or modification time differ are transferred, or whose checksum differs
+// with opts.Checksum. Remote files missing locally are removed with
+// opts.Delete.
+func (c *Client) SyncFiles(ctx context.Context, localPath, remotePath string, opts TransferOptions, ch chan<- Response) {
+	start := time.Now()
+	var written int64
+	var stats SyncStats
+	// mismatched are the files which failed verification
+	var mismatched []string
+	defer c.watch(ctx)()
+
+	fail := func(err error) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = cancelError(ctxErr)
+		}
+		ch <- Response{
+			Addr:     c.Addr,
+			Attempts: c.Attempts,
+			Output:   "",
+			Err:      err,
+			Bytes:    written,
+			Duration: time.Since(start),
+		}
+	}
+
+	localInfo, err := os.Stat(localPath)
+	if err != nil {
+		fail(fmt.Errorf("local %s is not exist, %s", localPath, err))
+		return
+	}
+	if _, err := c.remoteOwner(opts.Chown); err != nil {
+		fail(err)
+		return
+	}
+
+	// A file goes into a remote directory, like cp does
+	if remoteInfo, err := c.Stat(remotePath); err == nil && remoteInfo.IsDir() && !localInfo.IsDir() {
+		remotePath = path.Join(remotePath, filepath.Base(localPath))
+	}
+
+	remote, err := c.listRemote(remotePath)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	// Changed files are rewritten from the start, resuming would append to
+	// a remote file which only shares its size or prefix by chance
+	fileOpts := opts
+	fileOpts.Force = true
+	fileOpts.Resume = false
+
+	seen := map[string]bool{}
+	var dirs []transferredDir
+	err = filepath.Walk(localPath, func(local string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		target, err := syncTarget(localPath, remotePath, local)
+		if err != nil {
+			return err
+		}
+		seen[target] = true
+		remoteInfo, exists := remote[target]
+		if exists && remoteInfo.IsDir() != info.IsDir() {
+			// A file replaces a directory or the other way round, a
+			// directory with content only goes with --delete
+			if remoteInfo.IsDir() && !opts.Delete && hasChildren(remote, target) {
+				return fmt.Errorf("remote %s is a non-empty directory, use --delete to replace it with a file", target)
+			}
+			n, err := c.removeAll(target)
+			stats.Deleted += n
+			if err != nil {
+				return err
+			}
+			for p := range remote {
+				if strings.HasPrefix(p, target+"/") {
+					delete(remote, p)
+				}
+			}
+			exists = false
+		}
+
+		if info.IsDir() {
+			if !exists {
+				if err := c.MkdirAll(target); err != nil {
+					return err
+				}
+			}
+			if wantsAttrs(opts) {
+				dirs = append(dirs, transferredDir{path: target, info: info})
+			}
+			return nil
+		}
+
+		if exists {
+			same, err := c.unchanged(ctx, local, target, info, remoteInfo, opts)
+			if err != nil {
+				return err
+			}
+			if same {
+				stats.Unchanged++
+				if wantsAttrs(opts) {
+					return c.setRemoteAttrs(target, info, opts)
+				}
+				return nil
+			}
+		}
+
+		n, err := c.UploadFile(ctx, local, target, fileOpts)
+		written += n
+		if errors.Is(err, errChecksumMismatch) {
+			mismatched = append(mismatched, target)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Files are always given the modification time of their source, it
+		// is what the next sync compares
+		if !opts.Preserve {
+			if err := c.Chtimes(target, atime(info), info.ModTime()); err != nil {
+				return fmt.Errorf("failed to set times of %s, %s", target, err)
+			}
+		}
+		if exists {
+			stats.Updated++
+		} else {
+			stats.Created++
+		}
+		return nil
+	})
+	if err == nil && opts.Delete {
+		var n int
+		n, err = c.deleteExtra(remote, seen)
+		stats.Deleted += n
+	}
+	for i := len(dirs) - 1; i >= 0 && err == nil; i-- {
+		err = c.setRemoteAttrs(dirs[i].path, dirs[i].info, opts)
+	}
+	if err == nil && len(mismatched) > 0 {
+		err = mismatchError(mismatched, opts)
+	}
+	if err != nil {
+		fail(fmt.Errorf("%s (%s)", err, stats))
+		return
+	}
+
+	ch <- Response{
+		Addr:     c.Addr,
+		Attempts: c.Attempts,
+		Output:   fmt.Sprintf("%s -> %s:%s, %s", localPath, c.Addr, remotePath, stats),
+		Err:      nil,
+		Bytes:    written,
+		Duration: time.Since(start),
+	}
+}
+
+// syncTarget returns the remote path of local, a file or directory under
+// localRoot. filepath.Walk cleans the paths it visits, so local is made
+// relative rather than cut by the length of localRoot.
+func syncTarget(localRoot, remoteRoot, local string) (string, error) {
+	rel, err := filepath.Rel(localRoot, local)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(remoteRoot, filepath.ToSlash(rel)), nil
+}
+
+// hasChildren reports whether the remote listing has entries under dir
+func hasChildren(remote map[string]fs.FileInfo, dir string) bool {
+	for p := range remote {
+		if strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unchanged reports whether a remote file matches its local source
+func (c *Client) unchanged(ctx context.Context, localFile, remoteFile string, local, remote fs.FileInfo, opts TransferOptions) (bool, error) {
+	if !remote.Mode().IsRegular() || local.Size() != remote.Size() {
+		return false, nil
+	}
+	if !opts.Checksum {
+		// SFTP times have a precision of a second
+		return local.ModTime().Unix() == remote.ModTime().Unix(), nil
+	}
+
+	algo := opts.Verify
+	if algo == "" {
+		algo = SHA256
+	}
+	err := c.verify(ctx, localFile, remoteFile, algo)
+	if errors.Is(err, errChecksumMismatch) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// listRemote returns the files and directories under root by path, none
+// when root doesn't exist
+func (c *Client) listRemote(root string) (map[string]fs.FileInfo, error) {
+	files := map[string]fs.FileInfo{}
+	if _, err := c.Lstat(root); errors.Is(err, os.ErrNotExist) {
+		return files, nil
+	}
+
+	w := c.Walk(root)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return nil, err
+		}
+		files[path.Clean(w.Path())] = w.Stat()
+	}
+	return files, nil
+}
+
+// deleteExtra removes the remote files and directories not seen locally, it
+// returns the number of files removed
+func (c *Client) deleteExtra(remote map[string]fs.FileInfo, seen map[string]bool) (int, error) {
+	var extra []string
+	for p := range remote {
+		// Only the top of a missing tree, removing it removes the rest
+		if !seen[p] && seen[path.Dir(p)] {
+			extra = append(extra, p)
+		}
+	}
+	sort.Strings(extra)
+
+	deleted := 0
+	for _, p := range extra {
+		n, err := c.removeAll(p)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// removeAll removes a remote file or directory tree, it returns the number
+// of files removed
+func (c *Client) removeAll(name string) (int, error) {
+	info, err := c.Lstat(name)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		if err := c.Remove(name); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	entries, err := c.ReadDir(name)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		n, err := c.removeAll(path.Join(name, e.Name()))
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	if err := c.RemoveDirectory(name); err != nil {
+		return removed, err
+	}
+	return removed, nil
+}
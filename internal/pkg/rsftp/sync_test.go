@@ -0,0 +1,58 @@
+package rsftp
+
+import (
+	"io/fs"
+	"testing"
+)
+
+func TestSyncTarget(t *testing.T) {
+	tests := []struct {
+		localRoot  string
+		remoteRoot string
+		local      string
+		want       string
+	}{
+		{"app", "/opt/app", "app", "/opt/app"},
+		{"app", "/opt/app", "app/config.yaml", "/opt/app/config.yaml"},
+		{"./app", "/opt/app", "app", "/opt/app"},
+		{"./app", "/opt/app", "app/config.yaml", "/opt/app/config.yaml"},
+		{"./app", "/opt/app", "app/sub/x", "/opt/app/sub/x"},
+		{"app/", "/opt/app", "app/config.yaml", "/opt/app/config.yaml"},
+		{"./app/", "/opt/app/", "app/sub/x", "/opt/app/sub/x"},
+		{"/src/app", "/opt/app", "/src/app/sub/x", "/opt/app/sub/x"},
+		{"./app.conf", "/etc/app.conf", "app.conf", "/etc/app.conf"},
+	}
+	for _, tt := range tests {
+		got, err := syncTarget(tt.localRoot, tt.remoteRoot, tt.local)
+		if err != nil {
+			t.Errorf("syncTarget(%q, %q, %q) error %s", tt.localRoot, tt.remoteRoot, tt.local, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("syncTarget(%q, %q, %q) = %q, want %q", tt.localRoot, tt.remoteRoot, tt.local, got, tt.want)
+		}
+	}
+}
+
+func TestHasChildren(t *testing.T) {
+	remote := map[string]fs.FileInfo{
+		"/etc/app":          nil,
+		"/etc/app/app.conf": nil,
+		"/etc/empty":        nil,
+		"/etc/apps":         nil,
+	}
+	tests := []struct {
+		dir  string
+		want bool
+	}{
+		{"/etc/app", true},
+		{"/etc/empty", false},
+		{"/etc/ap", false},
+		{"/etc/apps", false},
+	}
+	for _, tt := range tests {
+		if got := hasChildren(remote, tt.dir); got != tt.want {
+			t.Errorf("hasChildren(%q) = %v, want %v", tt.dir, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package rssh
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sshtools/internal/pkg/rsftp"
+	"sshtools/internal/pkg/shell"
+	"strings"
+)
+
+// defaultShells run scripts without a shebang line, the first one found on
+// the server is used
+var defaultShells = []string{"/bin/bash", "/bin/sh"}
+
+// readShebang returns the interpreter and its arguments from the '#!' line
+// of localFile, or nil if there is none
+func readShebang(localFile string) ([]string, error) {
+	f, err := os.Open(localFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(line, "#!") {
+		return nil, nil
+	}
+	return strings.Fields(line[2:]), nil
+}
+
+// findInterpreter returns the command line running localFile on the server,
+// from override, the shebang line of the script or the default shells. The
+// interpreter is checked to exist on the server.
+func (c *Client) findInterpreter(sc *rsftp.Client, localFile, override string) ([]string, error) {
+	argv := strings.Fields(override)
+	if len(argv) == 0 {
+		var err error
+		argv, err = readShebang(localFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(argv) == 0 {
+		for _, s := range defaultShells {
+			if _, err := sc.Stat(s); err == nil {
+				return []string{s}, nil
+			}
+		}
+		return nil, fmt.Errorf("These files '%s' do not exists on the remote ssh server", strings.Join(defaultShells, ","))
+	}
+
+	prog := argv[0]
+	if path.IsAbs(prog) {
+		if _, err := sc.Stat(prog); err != nil {
+			return nil, fmt.Errorf("interpreter %s not found on the server", prog)
+		}
+		if path.Base(prog) != "env" {
+			return argv, nil
+		}
+		// '#!/usr/bin/env python3' looks the program up in PATH
+		prog = ""
+		for _, arg := range argv[1:] {
+			if !strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") {
+				prog = arg
+				break
+			}
+		}
+		if prog == "" {
+			return argv, nil
+		}
+	}
+
+	if err := c.lookPath(prog); err != nil {
+		return nil, err
+	}
+	return argv, nil
+}
+
+// lookPath checks that prog is in the PATH of the server
+func (c *Client) lookPath(prog string) error {
+	session, err := c.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session, %s", err)
+	}
+	defer session.Close()
+
+	if err := session.Run("command -v " + shell.Quote(prog) + " >/dev/null"); err != nil {
+		return fmt.Errorf("interpreter %s not found on the server", prog)
+	}
+	return nil
+}
@@ -1,55 +1,63 @@
 package rssh
 
 import (
+	"context"
 	"fmt"
+	"sshtools/internal/pkg/pool"
+	"sshtools/internal/pkg/sshconn"
 	"sync"
+	"time"
 )
 
 type MultiClient struct {
 	clients []*Client
+	dialer  *sshconn.Dialer
+	pool    *pool.Pool
 }
 
-func NewMultiClient(cfgs []ClientConfig) (*MultiClient, error) {
+// NewMultiClient connects to the servers concurrently, as many at once as p
+// allows, which also bounds every later operation on them. Servers that
+// can't be connected don't stop the others, they are returned as failed
+// responses.
+func NewMultiClient(ctx context.Context, cfgs []ClientConfig, p *pool.Pool) (*MultiClient, []Response) {
 	clients := []*Client{}
+	dialer := sshconn.NewDialer()
 
 	clientChan := make(chan *Client, len(cfgs))
-	errChan := make(chan error, len(cfgs))
+	failChan := make(chan Response, len(cfgs))
 	var wg sync.WaitGroup
 	for _, config := range cfgs {
 		wg.Add(1)
 		cfg := config
 		go func() {
 			defer wg.Done()
-			newClientWithChannel(cfg, clientChan, errChan)
+			defer p.Acquire(cfg.Group)()
+			newClientWithChannel(ctx, cfg, dialer, clientChan, failChan)
 		}()
 	}
 	wg.Wait()
 	close(clientChan)
-	close(errChan)
-
-	var errs error
-	for err := range errChan {
-		if err != nil {
-			errs = fmt.Errorf("%v;%v", errs, err)
-		}
-	}
-
-	if errs != nil {
-		return nil, errs
-	}
+	close(failChan)
 
 	for c := range clientChan {
 		clients = append(clients, c)
 	}
 
+	failed := []Response{}
+	for resp := range failChan {
+		failed = append(failed, resp)
+	}
+
 	mc := &MultiClient{
 		clients: clients,
+		dialer:  dialer,
+		pool:    p,
 	}
 
-	return mc, nil
+	return mc, failed
 }
 
-func (mc *MultiClient) execCmdOrScript(s string, isScript bool) []Response {
+func (mc *MultiClient) execCmdOrScript(ctx context.Context, s string, isScript bool, opts ExecOptions) []Response {
 	var wg sync.WaitGroup
 
 	respChan := make(chan Response, len(mc.clients))
@@ -58,10 +66,13 @@ func (mc *MultiClient) execCmdOrScript(s string, isScript bool) []Response {
 		c := client
 		go func() {
 			defer wg.Done()
+			defer mc.pool.Acquire(c.Group)()
+			ctx, cancel := withTimeout(ctx, opts.Timeout)
+			defer cancel()
 			if isScript {
-				c.ExecShellScript(s, respChan)
+				c.ExecShellScript(ctx, s, opts, respChan)
 			} else {
-				c.ExecCmd(s, respChan)
+				c.ExecCmd(ctx, s, opts, respChan)
 			}
 		}()
 	}
@@ -76,12 +87,20 @@ func (mc *MultiClient) execCmdOrScript(s string, isScript bool) []Response {
 	return resps
 }
 
-func (mc *MultiClient) ExecCmd(cmd string) []Response {
-	return mc.execCmdOrScript(cmd, false)
+func (mc *MultiClient) ExecCmd(ctx context.Context, cmd string, opts ExecOptions) []Response {
+	return mc.execCmdOrScript(ctx, cmd, false, opts)
 }
 
-func (mc *MultiClient) ExecShellScript(localFile string) []Response {
-	return mc.execCmdOrScript(localFile, true)
+func (mc *MultiClient) ExecShellScript(ctx context.Context, localFile string, opts ExecOptions) []Response {
+	return mc.execCmdOrScript(ctx, localFile, true, opts)
+}
+
+// withTimeout bounds ctx by timeout unless it is 0
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 func (mc *MultiClient) Close() error {
@@ -91,5 +110,8 @@ func (mc *MultiClient) Close() error {
 			err = fmt.Errorf("%s; %s close failed, %s", err, c.Addr, e)
 		}
 	}
+	if e := mc.dialer.Close(); e != nil {
+		err = fmt.Errorf("%s; %s", err, e)
+	}
 	return err
 }
@@ -1,170 +1,355 @@
 package rssh
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"sshtools/internal/pkg/become"
 	"sshtools/internal/pkg/rsftp"
+	"sshtools/internal/pkg/shell"
+	"sshtools/internal/pkg/sshconn"
 	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
-type ClientConfig struct {
-	Addr           string `json:"addr" mapstructure:"addr"`
-	Username       string `json:"username" mapstructure:"username"`
-	Password       string `json:"password" mapstructure:"password"`
-	PrivateKeyPath string `json:"privateKeyPath" mapstructure:"privateKeyPath"`
-}
+type ClientConfig = sshconn.Config
 
 type Response struct {
-	Addr       string
-	Output     string
+	Addr   string
+	Stdout string
+	Stderr string
+	// ExitStatus is -1 when the command didn't run or exited without status
 	ExitStatus int
+	// Signal is the name of the signal that killed the command, if any
+	Signal   string
+	Duration time.Duration
+	// Attempts is the number of connection attempts made to the host
+	Attempts int
+	// KeptScript is the path of the script left on the host with
+	// ExecOptions.KeepRemote
+	KeptScript string
 	Err        error
 }
 
+// ExecOptions controls how commands and scripts are executed
+type ExecOptions struct {
+	// OnLine, if set, streams the output line by line while the command runs
+	OnLine LineFunc
+	// Timeout bounds the time spent on each host, 0 means no limit
+	Timeout time.Duration
+	// Env holds the KEY=VALUE environment variables of the command
+	Env []string
+	// Args are passed to scripts as positional parameters
+	Args []string
+	// Interpreter runs scripts instead of the one in their shebang line,
+	// e.g. "python3 -u"
+	Interpreter string
+	// WorkDir is where a private directory holding the script is created,
+	// DefaultWorkDir when empty
+	WorkDir string
+	// KeepRemote keeps the uploaded script instead of removing it once run
+	KeepRemote bool
+	// StdinFile, if set, is a local file fed to the stdin of the command on
+	// every host
+	StdinFile string
+}
+
+// cancelGrace is how long a cancelled session may take to close before the
+// whole connection is dropped
+const cancelGrace = 2 * time.Second
+
 type Client struct {
 	*ssh.Client
 
-	Addr string
+	Addr     string
+	Group    string
+	Attempts int
+	// become, if set, runs commands as another user
+	become *become.Become
 }
 
-func NewClient(cfg ClientConfig) (*Client, error) {
-	sshConfig := &ssh.ClientConfig{
-		User:            cfg.Username,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         time.Second * 2,
-	}
-
-	if cfg.Password != "" {
-		sshConfig.Auth = []ssh.AuthMethod{
-			ssh.Password(cfg.Password),
-		}
-	} else if cfg.PrivateKeyPath != "" {
-		pemBytes, err := os.ReadFile(cfg.PrivateKeyPath)
-		if err != nil {
-			return nil, err
-		}
-		singner, err := ssh.ParsePrivateKey(pemBytes)
-		if err != nil {
-			return nil, err
-		}
-		sshConfig.Auth = []ssh.AuthMethod{
-			ssh.PublicKeys(singner),
-		}
-	} else {
-		return nil, errors.New("Provide the password or privateKeyPath.")
-	}
-
-	sshClient, err := ssh.Dial("tcp", cfg.Addr, sshConfig)
+func NewClient(ctx context.Context, cfg ClientConfig, dialer *sshconn.Dialer) (*Client, error) {
+	sshClient, attempts, err := dialer.Dial(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect %s, %s", cfg.Addr, err)
+		return nil, err
 	}
 
 	c := &Client{
-		Client: sshClient,
-		Addr:   cfg.Addr,
+		Client:   sshClient,
+		Addr:     cfg.Addr,
+		Group:    cfg.Group,
+		Attempts: attempts,
+	}
+	if cfg.Become != nil && *cfg.Become {
+		c.become = &become.Become{
+			Method:   cfg.BecomeMethod,
+			User:     cfg.BecomeUser,
+			Password: cfg.BecomePassword,
+			Pty:      cfg.BecomePty != nil && *cfg.BecomePty,
+		}
 	}
 
 	return c, nil
 }
 
-func (c *Client) ExecCmd(cmd string, ch chan<- Response) {
-	session, err := c.NewSession()
-	defer session.Close()
-	if err != nil {
+// ExecCmd runs cmd on the server. When ctx is done the remote command is sent
+// SIGTERM and the session closed.
+func (c *Client) ExecCmd(ctx context.Context, cmd string, opts ExecOptions, ch chan<- Response) {
+	start := time.Now()
+	if err := ctx.Err(); err != nil {
 		ch <- Response{
 			Addr:       c.Addr,
-			Output:     "",
 			ExitStatus: -1,
-			Err:        fmt.Errorf("failed to create session, %s", err),
+			Attempts:   c.Attempts,
+			Duration:   time.Since(start),
+			Err:        cancelError("command", err),
 		}
 		return
 	}
 
-	outByte, err := session.CombinedOutput(cmd)
-	if err != nil {
-		exitErr, ok := err.(*ssh.ExitError)
-		if !ok {
+	var stdin io.Reader
+	if opts.StdinFile != "" {
+		f, err := os.Open(opts.StdinFile)
+		if err != nil {
 			ch <- Response{
 				Addr:       c.Addr,
-				Output:     "",
 				ExitStatus: -1,
-				Err:        fmt.Errorf("unable to execute command, %s", err),
+				Attempts:   c.Attempts,
+				Duration:   time.Since(start),
+				Err:        fmt.Errorf("failed to open stdin, %s", err),
 			}
 			return
 		}
+		defer f.Close()
+		stdin = f
+	}
+
+	session, err := c.NewSession()
+	if err != nil {
 		ch <- Response{
 			Addr:       c.Addr,
-			Output:     "",
-			ExitStatus: exitErr.ExitStatus(),
-			Err:        fmt.Errorf("Failed to execute command '%s', %s", cmd, err),
+			ExitStatus: -1,
+			Attempts:   c.Attempts,
+			Duration:   time.Since(start),
+			Err:        fmt.Errorf("failed to create session, %s", err),
 		}
 		return
 	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if opts.OnLine != nil {
+		stdoutLines := &lineWriter{addr: c.Addr, onLine: opts.OnLine}
+		stderrLines := &lineWriter{addr: c.Addr, stderr: true, onLine: opts.OnLine}
+		defer stdoutLines.Flush()
+		defer stderrLines.Flush()
+		session.Stdout = io.MultiWriter(&stdout, stdoutLines)
+		session.Stderr = io.MultiWriter(&stderr, stderrLines)
+	}
 
-	ch <- Response{
-		Addr:       c.Addr,
-		Output:     string(outByte),
-		ExitStatus: 0,
-		Err:        nil,
+	err = c.run(ctx, session, c.setenv(session, cmd, opts.Env), stdin)
+	resp := Response{
+		Addr:     c.Addr,
+		Attempts: c.Attempts,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
 	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		resp.ExitStatus = -1
+		resp.Err = cancelError("command", ctxErr)
+	} else if err != nil {
+		exitErr, ok := err.(*ssh.ExitError)
+		if !ok {
+			resp.ExitStatus = -1
+			resp.Err = fmt.Errorf("unable to execute command, %s", err)
+		} else {
+			resp.ExitStatus = exitErr.ExitStatus()
+			resp.Signal = exitErr.Signal()
+			resp.Err = fmt.Errorf("Failed to execute command '%s', %s", cmd, err)
+		}
+	}
+
+	ch <- resp
 }
 
-// Upload shell script to remote SSH server and execute it
-func (c *Client) ExecShellScript(localFile string, ch chan<- Response) {
-	sc, err := rsftp.NewClient(c.Client, c.Addr)
-	if err != nil {
-		ch <- Response{
-			Addr:       c.Addr,
-			Output:     "",
-			ExitStatus: -1,
-			Err:        err,
+// setenv sets env on the session. Servers only accept the variables listed
+// in their AcceptEnv, so cmd is prefixed with exports when one is refused.
+// Commands run as another user always get the exports since sudo and su
+// reset the environment.
+func (c *Client) setenv(session *ssh.Session, cmd string, env []string) string {
+	if len(env) == 0 {
+		return cmd
+	}
+	if c.become == nil {
+		accepted := true
+		for _, kv := range env {
+			k, v, _ := strings.Cut(kv, "=")
+			if err := session.Setenv(k, v); err != nil {
+				accepted = false
+				break
+			}
+		}
+		if accepted {
+			return cmd
+		}
+	}
+	return shell.Exports(env) + cmd
+}
+
+// run starts cmd with stdin, as the become user if any, and waits for it,
+// or for ctx to be done
+func (c *Client) run(ctx context.Context, session *ssh.Session, cmd string, stdin io.Reader) error {
+	var proc *become.Process
+	if c.become != nil {
+		var err error
+		proc, err = c.become.Start(session, cmd, stdin, session.Stdout, session.Stderr)
+		if err != nil {
+			return err
+		}
+	} else {
+		session.Stdin = stdin
+		if err := session.Start(cmd); err != nil {
+			return err
 		}
-		return
 	}
 
-	name := fmt.Sprintf("%s_%s", time.Now().Format("20060102150405"), filepath.Base(localFile))
-	remoteFile := filepath.Join("/tmp/scripts", name)
-	if err := sc.UploadFile(localFile, remoteFile, true); err != nil {
+	done := make(chan error, 1)
+	go func() {
+		err := session.Wait()
+		if proc != nil {
+			if becomeErr := proc.Err(); becomeErr != nil {
+				err = becomeErr
+			}
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	session.Signal(ssh.SIGTERM)
+	session.Close()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(cancelGrace):
+		// The server doesn't close the session, drop the connection
+		c.Client.Close()
+		return <-done
+	}
+}
+
+// cancelError reports an operation stopped because its context is done
+func cancelError(what string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out, %w", what, err)
+	}
+	return fmt.Errorf("%s cancelled, %w", what, err)
+}
+
+// Upload shell script to remote SSH server and execute it. The script is
+// uploaded to a private directory under opts.WorkDir, removed afterwards
+// unless opts.KeepRemote is set.
+func (c *Client) ExecShellScript(ctx context.Context, localFile string, opts ExecOptions, ch chan<- Response) {
+	start := time.Now()
+	fail := func(err error) {
 		ch <- Response{
 			Addr:       c.Addr,
-			Output:     "",
 			ExitStatus: -1,
+			Attempts:   c.Attempts,
+			Duration:   time.Since(start),
 			Err:        err,
 		}
+	}
+
+	sc, err := rsftp.NewClient(c.Client, c.Addr)
+	if err != nil {
+		fail(err)
 		return
 	}
+	defer sc.Close()
 
-	var shell string
-	shells := []string{"/bin/bash", "/bin/sh"}
-	for _, s := range shells {
-		if _, err := sc.Stat(s); err == nil {
-			shell = s
-			break
-		}
+	interpreter, err := c.findInterpreter(sc, localFile, opts.Interpreter)
+	if err != nil {
+		fail(err)
+		return
 	}
-	if shell == "" {
-		ch <- Response{
-			Addr:       c.Addr,
-			Output:     "",
-			ExitStatus: -1,
-			Err:        fmt.Errorf("These files '%s' do not exists on the remote ssh server", strings.Join(shells, ",")),
+
+	dir, err := makeWorkDir(sc, opts.WorkDir)
+	if err != nil {
+		fail(err)
+		return
+	}
+	remoteFile := path.Join(dir, filepath.Base(localFile))
+	if _, err := sc.UploadFile(ctx, localFile, remoteFile, rsftp.TransferOptions{Force: true}); err != nil {
+		if !opts.KeepRemote {
+			sc.Remove(remoteFile)
+			sc.RemoveDirectory(dir)
 		}
+		fail(err)
 		return
 	}
 
-	command := fmt.Sprintf("%s %s", shell, remoteFile)
-	c.ExecCmd(command, ch)
+	if c.become != nil && c.become.TargetUser() != "root" {
+		// The become user must be able to read the script, the random name
+		// of the directory keeps it from being listed
+		sc.Chmod(dir, 0711)
+		sc.Chmod(remoteFile, 0644)
+	}
+
+	argv := append(append(interpreter, remoteFile), opts.Args...)
+	command := shell.Join(argv)
+	respChan := make(chan Response, 1)
+	c.ExecCmd(ctx, command, opts, respChan)
+	resp := <-respChan
+	if opts.KeepRemote {
+		resp.KeptScript = remoteFile
+	} else if err := removeWorkDir(sc, dir, remoteFile); err != nil && resp.Err == nil {
+		resp.Err = err
+	}
+	// The duration includes the upload of the script
+	resp.Duration = time.Since(start)
+	ch <- resp
 }
 
-func newClientWithChannel(cfg ClientConfig, ch chan<- *Client, errch chan<- error) {
-	client, err := NewClient(cfg)
-	errch <- err
+func newClientWithChannel(ctx context.Context, cfg ClientConfig, dialer *sshconn.Dialer, ch chan<- *Client, failch chan<- Response) {
+	start := time.Now()
+	if err := ctx.Err(); err != nil {
+		failch <- Response{
+			Addr:       cfg.Addr,
+			ExitStatus: -1,
+			Duration:   time.Since(start),
+			Err:        cancelError("connection", err),
+		}
+		return
+	}
+
+	client, err := NewClient(ctx, cfg, dialer)
 	if err != nil {
+		resp := Response{
+			Addr:       cfg.Addr,
+			ExitStatus: -1,
+			Duration:   time.Since(start),
+			Err:        err,
+		}
+		var connErr *sshconn.ConnectError
+		if errors.As(err, &connErr) {
+			resp.Attempts = connErr.Attempts
+		}
+		failch <- resp
 		return
 	}
 	ch <- client
@@ -0,0 +1,38 @@
+package rssh
+
+import (
+	"bytes"
+)
+
+// LineFunc receives a line of command output as soon as it is complete,
+// stderr tells which stream it came from
+type LineFunc func(addr string, stderr bool, line string)
+
+// lineWriter splits the output written to it into lines passed to onLine
+type lineWriter struct {
+	addr   string
+	stderr bool
+	onLine LineFunc
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.onLine(w.addr, w.stderr, string(bytes.TrimSuffix(w.buf[:i], []byte("\r"))))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush passes the last line if it isn't terminated by a newline
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.onLine(w.addr, w.stderr, string(w.buf))
+		w.buf = nil
+	}
+}
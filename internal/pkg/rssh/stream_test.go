@@ -0,0 +1,46 @@
+package rssh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []string
+	}{
+		{"none", nil, nil},
+		{"one line", []string{"a\n"}, []string{"a"}},
+		{"lines in one write", []string{"a\nb\nc\n"}, []string{"a", "b", "c"}},
+		{"line across writes", []string{"he", "llo", "\nwor", "ld\n"}, []string{"hello", "world"}},
+		{"unterminated last line", []string{"a\nb"}, []string{"a", "b"}},
+		{"empty lines", []string{"\n\na\n"}, []string{"", "", "a"}},
+		{"crlf", []string{"a\r\nb\r", "\n"}, []string{"a", "b"}},
+		{"lone cr", []string{"a\rb\n"}, []string{"a\rb"}},
+	}
+	for _, tt := range tests {
+		var lines []string
+		w := &lineWriter{
+			addr:   "10.0.0.1:22",
+			stderr: true,
+			onLine: func(addr string, stderr bool, line string) {
+				if addr != "10.0.0.1:22" || !stderr {
+					t.Errorf("%s: line of %s, stderr %v", tt.name, addr, stderr)
+				}
+				lines = append(lines, line)
+			},
+		}
+		for _, s := range tt.writes {
+			if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+				t.Errorf("%s: Write(%q) = %d, %v", tt.name, s, n, err)
+			}
+		}
+		w.Flush()
+		w.Flush()
+		if !reflect.DeepEqual(lines, tt.want) {
+			t.Errorf("%s: lines %q, want %q", tt.name, lines, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package rssh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sshtools/internal/pkg/rsftp"
+)
+
+// DefaultWorkDir is where scripts are uploaded when no work dir is given
+const DefaultWorkDir = "/tmp"
+
+// makeWorkDir creates a directory only the login user can access under
+// workDir, falling back to the home directory when workDir can't be written
+// to. Scripts are passed to their interpreter rather than executed, so a
+// noexec mount doesn't prevent them from running.
+func makeWorkDir(sc *rsftp.Client, workDir string) (string, error) {
+	if workDir == "" {
+		workDir = DefaultWorkDir
+	}
+
+	dir, err := mkdirTemp(sc, workDir)
+	if err == nil {
+		return dir, nil
+	}
+	home, homeErr := sc.Getwd()
+	if homeErr != nil || home == workDir {
+		return "", err
+	}
+	if dir, homeErr := mkdirTemp(sc, home); homeErr == nil {
+		return dir, nil
+	}
+	return "", err
+}
+
+// mkdirTemp creates a uniquely named directory with mode 0700 in parent,
+// like mktemp -d
+func mkdirTemp(sc *rsftp.Client, parent string) (string, error) {
+	if err := sc.MkdirAll(parent); err != nil {
+		return "", fmt.Errorf("failed to create work dir %s, %s", parent, err)
+	}
+
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	dir := path.Join(parent, "sshtools."+hex.EncodeToString(b))
+	// Mkdir fails if the directory exists, nobody else can have prepared it
+	if err := sc.Mkdir(dir); err != nil {
+		return "", fmt.Errorf("failed to create work dir in %s, %s", parent, err)
+	}
+	if err := sc.Chmod(dir, 0700); err != nil {
+		sc.RemoveDirectory(dir)
+		return "", fmt.Errorf("failed to restrict work dir %s, %s", dir, err)
+	}
+
+	abs, err := sc.RealPath(dir)
+	if err != nil {
+		return dir, nil
+	}
+	return abs, nil
+}
+
+// removeWorkDir removes the work dir and the script uploaded to it
+func removeWorkDir(sc *rsftp.Client, dir, remoteFile string) error {
+	if err := sc.Remove(remoteFile); err != nil {
+		return fmt.Errorf("failed to remove %s, %s", remoteFile, err)
+	}
+	if err := sc.RemoveDirectory(dir); err != nil {
+		return fmt.Errorf("failed to remove %s, %s", dir, err)
+	}
+	return nil
+}
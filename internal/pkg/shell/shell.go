@@ -0,0 +1,50 @@
+package shell
+
+import (
+	"strings"
+)
+
+// Quote quotes s for a POSIX shell, it is left as is when it only contains
+// characters that are never special
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range s {
+		if !isSafe(r) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Join quotes args and joins them into a command line
+func Join(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = Quote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Exports returns the export commands setting env, a list of KEY=VALUE,
+// followed by a newline so a script can be appended
+func Exports(env []string) string {
+	if len(env) == 0 {
+		return ""
+	}
+	return "export " + Join(env) + "\n"
+}
+
+func isSafe(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("@%+=:,./-_", r)
+}
@@ -0,0 +1,90 @@
+package shell
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"", "''"},
+		{"abc", "abc"},
+		{"/etc/app.conf", "/etc/app.conf"},
+		{"KEY=value,a:b@c%d+e-f_g", "KEY=value,a:b@c%d+e-f_g"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{"'", `''\'''`},
+		{"''", `''\'''\'''`},
+		{"a\nb", "'a\nb'"},
+		{"$HOME", "'$HOME'"},
+		{"`id`", "'`id`'"},
+		{"a;b&c|d", "'a;b&c|d'"},
+		{`"quoted"`, `'"quoted"'`},
+		{`back\slash`, `'back\slash'`},
+		{"*", "'*'"},
+		{"~", "'~'"},
+		{"héllo", "'héllo'"},
+	}
+	for _, tt := range tests {
+		if got := Quote(tt.s); got != tt.want {
+			t.Errorf("Quote(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteShell(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to run")
+	}
+	for _, s := range []string{"", "a b", "it's", "'", "a\nb\n", "$HOME `id` $(id)", `\"'\`, "-n", "*", "\t"} {
+		out, err := exec.Command(sh, "-c", "printf %s "+Quote(s)).Output()
+		if err != nil {
+			t.Errorf("sh -c printf %%s %s: %s", Quote(s), err)
+			continue
+		}
+		if string(out) != s {
+			t.Errorf("sh printed %q for Quote(%q), want it back", out, s)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"ls"}, "ls"},
+		{[]string{"echo", "a b", ""}, "echo 'a b' ''"},
+		{[]string{"--", "it's"}, `-- 'it'\''s'`},
+	}
+	for _, tt := range tests {
+		if got := Join(tt.args); got != tt.want {
+			t.Errorf("Join(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestExports(t *testing.T) {
+	tests := []struct {
+		env  []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{}, ""},
+		{[]string{"A=1"}, "export A=1\n"},
+		{[]string{"A=1", "B=two words"}, "export A=1 'B=two words'\n"},
+		{[]string{"A="}, "export A=\n"},
+		{[]string{"MSG=it's"}, `export 'MSG=it'\''s'` + "\n"},
+		{[]string{"LINES=a\nb"}, "export 'LINES=a\nb'\n"},
+	}
+	for _, tt := range tests {
+		if got := Exports(tt.env); got != tt.want {
+			t.Errorf("Exports(%q) = %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
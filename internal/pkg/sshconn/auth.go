@@ -0,0 +1,259 @@
+package sshconn
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Authentication methods which can be combined into an auth chain
+const (
+	AuthAgent               = "agent"
+	AuthPublicKey           = "publickey"
+	AuthPassword            = "password"
+	AuthKeyboardInteractive = "keyboard-interactive"
+)
+
+// AuthMethods lists the accepted values of an auth chain entry
+var AuthMethods = []string{AuthAgent, AuthPublicKey, AuthPassword, AuthKeyboardInteractive}
+
+var (
+	agentOnce sync.Once
+	agentConn agent.ExtendedAgent
+	agentErr  error
+)
+
+// sshAgent returns the client of the agent listening on SSH_AUTH_SOCK, the
+// connection is opened once and shared by all hosts.
+func sshAgent() (agent.ExtendedAgent, error) {
+	agentOnce.Do(func() {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			agentErr = errors.New("SSH_AUTH_SOCK is not set")
+			return
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			agentErr = fmt.Errorf("failed to connect ssh-agent, %s", err)
+			return
+		}
+		agentConn = agent.NewClient(conn)
+	})
+	return agentConn, agentErr
+}
+
+// ValidateAuthMethods returns an error if methods contains an unknown method
+func ValidateAuthMethods(methods []string) error {
+	for _, m := range methods {
+		if !contains(AuthMethods, m) {
+			return fmt.Errorf("invalid auth method %q, must be one of %s", m, strings.Join(AuthMethods, ","))
+		}
+	}
+	return nil
+}
+
+// privateKeyPaths returns the private key files of cfg in order, without
+// duplicates
+func privateKeyPaths(cfg Config) []string {
+	paths := []string{}
+	for _, p := range append([]string{cfg.PrivateKeyPath}, cfg.PrivateKeyPaths...) {
+		if p == "" {
+			continue
+		}
+		p = expandHome(p)
+		if !contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// defaultAuthMethods derives the auth chain of a host that doesn't configure
+// one: agent first, then key files, then password based methods.
+func defaultAuthMethods(cfg Config) []string {
+	methods := []string{}
+	if os.Getenv("SSH_AUTH_SOCK") != "" {
+		methods = append(methods, AuthAgent)
+	}
+	if len(privateKeyPaths(cfg)) > 0 {
+		methods = append(methods, AuthPublicKey)
+	}
+	if cfg.Password != "" {
+		methods = append(methods, AuthPassword, AuthKeyboardInteractive)
+	}
+	return methods
+}
+
+// authChain builds the ssh auth methods of a host and records which one of
+// them authenticated the connection
+type authChain struct {
+	names []string
+
+	mu   sync.Mutex
+	used string
+}
+
+func newAuthChain(cfg Config) (*authChain, []ssh.AuthMethod, error) {
+	names := cfg.AuthMethods
+	if len(names) == 0 {
+		names = defaultAuthMethods(cfg)
+	}
+	if len(names) == 0 {
+		return nil, nil, errors.New("Provide the password or privateKeyPath.")
+	}
+	if err := ValidateAuthMethods(names); err != nil {
+		return nil, nil, err
+	}
+
+	a := &authChain{names: names}
+	methods := []ssh.AuthMethod{}
+
+	// The ssh package tries each method name only once, so agent and key
+	// file signers are offered through a single publickey method, placed
+	// where the first of them appears in the chain.
+	signers := []ssh.Signer{}
+	publicKeyAdded := false
+	for _, name := range names {
+		switch name {
+		case AuthAgent:
+			ag, err := sshAgent()
+			if err != nil {
+				verbose.Printf("%s: skip agent authentication, %s", cfg.Addr, err)
+				continue
+			}
+			agentSigners, err := ag.Signers()
+			if err != nil {
+				verbose.Printf("%s: skip agent authentication, %s", cfg.Addr, err)
+				continue
+			}
+			for _, s := range agentSigners {
+				signers = append(signers, a.recordSigner(s, AuthAgent))
+			}
+		case AuthPublicKey:
+			paths := privateKeyPaths(cfg)
+			if len(paths) == 0 {
+				return nil, nil, errors.New("publickey authentication requires privateKeyPath")
+			}
+			certUsed := false
+			for _, path := range paths {
+				s, err := loadPrivateKey(cfg, path)
+				if err != nil {
+					return nil, nil, err
+				}
+				// Offer the certificate before the bare key, servers trusting
+				// the CA usually don't list the key in authorized_keys.
+				certSigner, certPath, err := loadCertificate(cfg, path, s)
+				if err != nil {
+					return nil, nil, err
+				}
+				if certSigner != nil {
+					certUsed = certUsed || certPath == expandHome(cfg.CertificatePath)
+					signers = append(signers, a.recordSigner(certSigner, fmt.Sprintf("%s (%s)", AuthPublicKey, certPath)))
+				}
+				signers = append(signers, a.recordSigner(s, fmt.Sprintf("%s (%s)", AuthPublicKey, path)))
+			}
+			if cfg.CertificatePath != "" && !certUsed {
+				return nil, nil, fmt.Errorf("certificate %s does not match any private key or is not valid", cfg.CertificatePath)
+			}
+		case AuthPassword:
+			if cfg.Password == "" {
+				return nil, nil, errors.New("password authentication requires password")
+			}
+			methods = append(methods, ssh.PasswordCallback(func() (string, error) {
+				a.record(AuthPassword)
+				return cfg.Password, nil
+			}))
+			continue
+		case AuthKeyboardInteractive:
+			if cfg.Password == "" {
+				return nil, nil, errors.New("keyboard-interactive authentication requires password")
+			}
+			methods = append(methods, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				a.record(AuthKeyboardInteractive)
+				answers := make([]string, len(questions))
+				for i := range questions {
+					if !echos[i] {
+						answers[i] = cfg.Password
+					}
+				}
+				return answers, nil
+			}))
+			continue
+		}
+
+		if !publicKeyAdded {
+			publicKeyAdded = true
+			methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				return signers, nil
+			}))
+		}
+	}
+
+	return a, methods, nil
+}
+
+func (a *authChain) record(method string) {
+	a.mu.Lock()
+	a.used = method
+	a.mu.Unlock()
+}
+
+// Used returns the method that was tried last, which is the one that
+// succeeded once the handshake completed
+func (a *authChain) Used() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.used
+}
+
+func (a *authChain) String() string {
+	return strings.Join(a.names, ",")
+}
+
+// recordSigner wraps s so that a signature made with it is recorded, the ssh
+// package only signs with a key after the server agreed to accept it.
+func (a *authChain) recordSigner(s ssh.Signer, method string) ssh.Signer {
+	rs := recordingSigner{Signer: s, record: func() { a.record(method) }}
+	if as, ok := s.(ssh.AlgorithmSigner); ok {
+		return recordingAlgorithmSigner{recordingSigner: rs, as: as}
+	}
+	return rs
+}
+
+type recordingSigner struct {
+	ssh.Signer
+	record func()
+}
+
+func (s recordingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	s.record()
+	return s.Signer.Sign(rand, data)
+}
+
+// recordingAlgorithmSigner keeps the ssh.AlgorithmSigner interface of the
+// wrapped signer, without it RSA keys fall back to SHA-1 signatures.
+type recordingAlgorithmSigner struct {
+	recordingSigner
+	as ssh.AlgorithmSigner
+}
+
+func (s recordingAlgorithmSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	s.record()
+	return s.as.SignWithAlgorithm(rand, data, algorithm)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
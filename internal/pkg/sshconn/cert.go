@@ -0,0 +1,72 @@
+package sshconn
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certificatePaths returns the certificate candidates of the private key at
+// keyPath: the configured certificate and the OpenSSH style <key>-cert.pub
+func certificatePaths(cfg Config, keyPath string) []string {
+	paths := []string{}
+	if cfg.CertificatePath != "" {
+		paths = append(paths, expandHome(cfg.CertificatePath))
+	}
+	if p := keyPath + "-cert.pub"; !contains(paths, p) {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// loadCertificate returns a signer presenting the certificate issued for the
+// key of signer, or nil if there is no usable certificate for it
+func loadCertificate(cfg Config, keyPath string, signer ssh.Signer) (ssh.Signer, string, error) {
+	for _, path := range certificatePaths(cfg, keyPath) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) && path != expandHome(cfg.CertificatePath) {
+				continue
+			}
+			return nil, "", fmt.Errorf("failed to read certificate %s, %s", path, err)
+		}
+
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to parse certificate %s, %s", path, err)
+		}
+		cert, ok := pub.(*ssh.Certificate)
+		if !ok {
+			return nil, "", fmt.Errorf("%s is not a certificate", path)
+		}
+		if cert.CertType != ssh.UserCert {
+			return nil, "", fmt.Errorf("%s is not a user certificate", path)
+		}
+
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			// The configured certificate may belong to another key of the host
+			continue
+		}
+		if err := checkValidity(cert); err != nil {
+			verbose.Printf("%s: skip certificate %s, %s", cfg.Addr, path, err)
+			continue
+		}
+		return certSigner, path, nil
+	}
+
+	return nil, "", nil
+}
+
+func checkValidity(cert *ssh.Certificate) error {
+	now := uint64(time.Now().Unix())
+	if now < cert.ValidAfter {
+		return fmt.Errorf("certificate is not valid until %s", time.Unix(int64(cert.ValidAfter), 0))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore {
+		return fmt.Errorf("certificate expired at %s", time.Unix(int64(cert.ValidBefore), 0))
+	}
+	return nil
+}
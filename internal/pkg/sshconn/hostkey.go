@@ -0,0 +1,429 @@
+package sshconn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key policies, they decide what happens when a server presents a key
+// that is not recorded in the known_hosts files.
+const (
+	// HostKeyStrict rejects unknown and changed host keys.
+	HostKeyStrict = "strict"
+	// HostKeyAcceptNew trusts unknown hosts on first use and records their
+	// key, changed keys are still rejected.
+	HostKeyAcceptNew = "accept-new"
+	// HostKeyInsecure skips host key verification entirely.
+	HostKeyInsecure = "insecure"
+)
+
+// HostKeyPolicies lists the accepted values of the host key policy
+var HostKeyPolicies = []string{HostKeyStrict, HostKeyAcceptNew, HostKeyInsecure}
+
+// acceptedKeys remembers keys trusted on first use during this run, so hosts
+// dialed more than once don't depend on re-reading the file we appended to.
+var (
+	acceptedMu   sync.Mutex
+	acceptedKeys = map[string]ssh.PublicKey{}
+)
+
+var (
+	plainHostKeyAlgos = []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+	}
+	certHostKeyAlgos = []string{
+		ssh.CertAlgoED25519v01,
+		ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+		ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01,
+	}
+)
+
+// probeKey is a throwaway key used to ask the known_hosts database which
+// keys it holds for a host
+var (
+	probeOnce sync.Once
+	probeKey  ssh.PublicKey
+)
+
+// HostKeyError is returned when a server's host key can't be verified
+type HostKeyError struct {
+	Addr string
+	Key  ssh.PublicKey
+	// Want holds the keys recorded for the host, it is empty when the host
+	// is unknown and non-empty when the key changed.
+	Want []knownhosts.KnownKey
+	Err  error
+}
+
+func (e *HostKeyError) Error() string {
+	fingerprint := ssh.FingerprintSHA256(e.Key)
+	if e.Mismatch() {
+		var want []string
+		for _, k := range e.Want {
+			want = append(want, fmt.Sprintf("%s:%d", k.Filename, k.Line))
+		}
+		return fmt.Sprintf("host key mismatch for %s, got %s %s, expected the key in %s, possible man-in-the-middle attack",
+			e.Addr, e.Key.Type(), fingerprint, strings.Join(want, ","))
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("host key verification failed for %s (%s %s), %s", e.Addr, e.Key.Type(), fingerprint, e.Err)
+	}
+	return fmt.Sprintf("host key for %s is unknown (%s %s), add it to known_hosts or use the accept-new policy",
+		e.Addr, e.Key.Type(), fingerprint)
+}
+
+func (e *HostKeyError) Unwrap() error {
+	return e.Err
+}
+
+// Mismatch reports whether the host is known with a different key
+func (e *HostKeyError) Mismatch() bool {
+	return len(e.Want) > 0
+}
+
+// HostKeyVerifier verifies host keys against the known_hosts files according
+// to a policy
+type HostKeyVerifier struct {
+	policy string
+	files  []string
+	// appendFile is where keys accepted on first use are recorded
+	appendFile string
+
+	mu  sync.Mutex
+	err *HostKeyError
+}
+
+// NewHostKeyVerifier creates a verifier reading ~/.ssh/known_hosts and the
+// optional extra file. An empty policy means HostKeyStrict.
+func NewHostKeyVerifier(policy, extraFile string) (*HostKeyVerifier, error) {
+	if policy == "" {
+		policy = HostKeyStrict
+	}
+	if err := ValidateHostKeyPolicy(policy); err != nil {
+		return nil, err
+	}
+
+	v := &HostKeyVerifier{policy: policy}
+	if home, err := os.UserHomeDir(); err == nil {
+		userFile := filepath.Join(home, ".ssh", "known_hosts")
+		v.files = append(v.files, userFile)
+		v.appendFile = userFile
+	}
+	if extraFile != "" {
+		extraFile = expandHome(extraFile)
+		v.files = append(v.files, extraFile)
+		v.appendFile = extraFile
+	}
+	if v.appendFile == "" && policy == HostKeyAcceptNew {
+		return nil, errors.New("unable to locate a known_hosts file to record new host keys")
+	}
+
+	return v, nil
+}
+
+// ValidateHostKeyPolicy returns an error if policy is not a known policy
+func ValidateHostKeyPolicy(policy string) error {
+	for _, p := range HostKeyPolicies {
+		if p == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid host key policy %q, must be one of %s", policy, strings.Join(HostKeyPolicies, ","))
+}
+
+// Callback implements ssh.HostKeyCallback
+func (v *HostKeyVerifier) Callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if v.policy == HostKeyInsecure {
+		return nil
+	}
+
+	err := v.check(hostname, remote, key)
+	if err != nil {
+		v.mu.Lock()
+		v.err = err
+		v.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Err returns the host key error recorded by the last callback, if any
+func (v *HostKeyVerifier) Err() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.err == nil {
+		return nil
+	}
+	return v.err
+}
+
+// HostKeyAlgorithms returns the host key algorithms to negotiate with addr.
+// Hosts recorded in known_hosts are only asked for the recorded key types, so
+// a server holding several keys doesn't present one that can't be verified.
+// Host certificates are preferred when a @cert-authority entry matches addr,
+// otherwise they are not requested at all.
+func (v *HostKeyVerifier) HostKeyAlgorithms(addr string) []string {
+	if v.policy == HostKeyInsecure {
+		return nil
+	}
+
+	files := existingFiles(v.files)
+	algos := []string{}
+	if hasAuthority(readCertAuthorities(files), addr, nil) {
+		algos = append(algos, certHostKeyAlgos...)
+	}
+
+	known := v.knownKeyTypes(addr, files)
+	if len(known) == 0 {
+		return append(algos, plainHostKeyAlgos...)
+	}
+	for _, algo := range plainHostKeyAlgos {
+		typ := algo
+		if algo == ssh.KeyAlgoRSASHA512 || algo == ssh.KeyAlgoRSASHA256 {
+			typ = ssh.KeyAlgoRSA
+		}
+		if contains(known, typ) {
+			algos = append(algos, algo)
+		}
+	}
+	return algos
+}
+
+// knownKeyTypes returns the types of the keys recorded for addr
+func (v *HostKeyVerifier) knownKeyTypes(addr string, files []string) []string {
+	types := []string{}
+
+	acceptedMu.Lock()
+	if k, ok := acceptedKeys[knownhosts.Normalize(addr)]; ok {
+		types = append(types, k.Type())
+	}
+	acceptedMu.Unlock()
+
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return types
+	}
+	probeOnce.Do(func() {
+		pub, _, _ := ed25519.GenerateKey(rand.Reader)
+		probeKey, _ = ssh.NewPublicKey(pub)
+	})
+
+	remote := &net.TCPAddr{IP: net.IPv4zero}
+	var keyErr *knownhosts.KeyError
+	if err := callback(addr, remote, probeKey); errors.As(err, &keyErr) {
+		for _, k := range keyErr.Want {
+			types = append(types, k.Key.Type())
+		}
+	}
+	return types
+}
+
+// certAuthority is a @cert-authority entry of a known_hosts file
+type certAuthority struct {
+	hosts []string
+	key   ssh.PublicKey
+}
+
+// readCertAuthorities returns the @cert-authority entries of files, a file
+// is read up to its first invalid line like knownhosts does
+func readCertAuthorities(files []string) []certAuthority {
+	var cas []certAuthority
+	for _, fn := range files {
+		rest, err := os.ReadFile(fn)
+		if err != nil {
+			continue
+		}
+		for {
+			var marker string
+			var hosts []string
+			var key ssh.PublicKey
+			marker, hosts, key, _, rest, err = ssh.ParseKnownHosts(rest)
+			if err != nil {
+				break
+			}
+			if marker == "cert-authority" {
+				cas = append(cas, certAuthority{hosts: hosts, key: key})
+			}
+		}
+	}
+	return cas
+}
+
+// hasAuthority reports whether one of cas is trusted for address, signing
+// with key unless key is nil
+func hasAuthority(cas []certAuthority, address string, key ssh.PublicKey) bool {
+	for _, ca := range cas {
+		if key != nil && !bytes.Equal(ca.key.Marshal(), key.Marshal()) {
+			continue
+		}
+		if matchKnownHosts(ca.hosts, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchKnownHosts reports whether address, 'host:port' or a host on port
+// 22, matches the host patterns of a known_hosts entry. Patterns follow
+// knownhosts: '*' and '?' wildcards, '!' negation, '[host]:port' for other
+// ports and hashed '|1|salt|hash' names.
+func matchKnownHosts(patterns []string, address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, "22"
+	}
+	normalized := knownhosts.Normalize(net.JoinHostPort(host, port))
+
+	matched := false
+	for _, p := range patterns {
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+
+		var ok bool
+		if strings.HasPrefix(p, "|1|") {
+			ok = matchHashedHost(p, normalized)
+		} else {
+			phost, pport, err := net.SplitHostPort(p)
+			if err != nil {
+				phost, pport = p, "22"
+			}
+			ok = pport == port && matchWildcard(phost, host)
+		}
+		if !ok {
+			continue
+		}
+		if negate {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// matchHashedHost reports whether a hashed known_hosts name is the one of
+// the normalized host
+func matchHashedHost(hashed, normalized string) bool {
+	parts := strings.Split(hashed, "|")
+	if len(parts) != 4 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(normalized))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+func (v *HostKeyVerifier) check(hostname string, remote net.Addr, key ssh.PublicKey) *HostKeyError {
+	normalized := knownhosts.Normalize(hostname)
+
+	acceptedMu.Lock()
+	accepted, ok := acceptedKeys[normalized]
+	acceptedMu.Unlock()
+	if ok && string(accepted.Marshal()) == string(key.Marshal()) {
+		return nil
+	}
+
+	files := existingFiles(v.files)
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return &HostKeyError{Addr: hostname, Key: key, Err: err}
+	}
+
+	// knownhosts never falls back to the plain key of a certificate, like
+	// OpenSSH a certificate without a trusted authority is checked as the
+	// key it certifies
+	if cert, ok := key.(*ssh.Certificate); ok && !hasAuthority(readCertAuthorities(files), hostname, cert.SignatureKey) {
+		key = cert.Key
+	}
+
+	err = callback(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return &HostKeyError{Addr: hostname, Key: key, Err: err}
+	}
+	if len(keyErr.Want) > 0 || v.policy != HostKeyAcceptNew {
+		return &HostKeyError{Addr: hostname, Key: key, Want: keyErr.Want}
+	}
+
+	if err := v.record(normalized, key); err != nil {
+		return &HostKeyError{Addr: hostname, Key: key, Err: err}
+	}
+	return nil
+}
+
+// record appends the key of a host seen for the first time to appendFile
+func (v *HostKeyVerifier) record(normalized string, key ssh.PublicKey) error {
+	acceptedMu.Lock()
+	defer acceptedMu.Unlock()
+
+	if accepted, ok := acceptedKeys[normalized]; ok {
+		if string(accepted.Marshal()) == string(key.Marshal()) {
+			return nil
+		}
+		return fmt.Errorf("host presented a different key than the one accepted earlier in this run")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(v.appendFile), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(v.appendFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to record host key in %s, %s", v.appendFile, err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{normalized}, key)); err != nil {
+		return fmt.Errorf("failed to record host key in %s, %s", v.appendFile, err)
+	}
+
+	acceptedKeys[normalized] = key
+	return nil
+}
+
+func existingFiles(files []string) []string {
+	existing := []string{}
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		}
+	}
+	return existing
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
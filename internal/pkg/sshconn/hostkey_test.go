@@ -0,0 +1,84 @@
+package sshconn
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestMatchKnownHosts(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		address  string
+		want     bool
+	}{
+		{[]string{"example.com"}, "example.com", true},
+		{[]string{"example.com"}, "example.com:22", true},
+		{[]string{"example.com"}, "example.com:2222", false},
+		{[]string{"[example.com]:2222"}, "example.com:2222", true},
+		{[]string{"[example.com]:2222"}, "example.com:22", false},
+		{[]string{"*.example.com"}, "web1.example.com:22", true},
+		{[]string{"*.example.com"}, "example.com:22", false},
+		{[]string{"web?.example.com"}, "web1.example.com:22", true},
+		{[]string{"[*.example.com]:2222"}, "web1.example.com:2222", true},
+		{[]string{"*", "!db.example.com"}, "web1.example.com:22", true},
+		{[]string{"*", "!db.example.com"}, "db.example.com:22", false},
+		{[]string{"!db.example.com", "*"}, "db.example.com:22", false},
+		{[]string{"!db.example.com"}, "web1.example.com:22", false},
+		{[]string{"10.0.0.*"}, "10.0.0.7:22", true},
+		{[]string{"10.0.0.*"}, "10.0.0.7:2201", false},
+		{[]string{knownhosts.HashHostname("example.com")}, "example.com:22", true},
+		{[]string{knownhosts.HashHostname("example.com")}, "other.com:22", false},
+		{[]string{knownhosts.HashHostname("[example.com]:2222")}, "example.com:2222", true},
+		{[]string{"|1|invalid"}, "example.com:22", false},
+	}
+	for _, tt := range tests {
+		if got := matchKnownHosts(tt.patterns, tt.address); got != tt.want {
+			t.Errorf("matchKnownHosts(%q, %q) = %v, want %v", tt.patterns, tt.address, got, tt.want)
+		}
+	}
+}
+
+// newTestKey returns a random ed25519 public key
+func newTestKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHasAuthority(t *testing.T) {
+	ca, other := newTestKey(t), newTestKey(t)
+	cas := []certAuthority{{hosts: []string{"*.example.com", "!db.example.com"}, key: ca}}
+
+	tests := []struct {
+		address string
+		key     ssh.PublicKey
+		want    bool
+	}{
+		{"web1.example.com:22", nil, true},
+		{"web1.example.com:22", ca, true},
+		{"web1.example.com:22", other, false},
+		{"db.example.com:22", nil, false},
+		{"db.example.com:22", ca, false},
+		{"web1.example.org:22", nil, false},
+		{"web1.example.com:2222", nil, false},
+	}
+	for _, tt := range tests {
+		if got := hasAuthority(cas, tt.address, tt.key); got != tt.want {
+			t.Errorf("hasAuthority(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+	if hasAuthority(nil, "web1.example.com:22", nil) {
+		t.Errorf("hasAuthority without entries = true, want false")
+	}
+}
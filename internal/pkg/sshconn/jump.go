@@ -0,0 +1,185 @@
+package sshconn
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpError is returned when a jump host on the way to a server fails
+type JumpError struct {
+	// Hop is the jump host that failed, as written in proxyJump
+	Hop string
+	Err error
+}
+
+func (e *JumpError) Error() string {
+	return fmt.Sprintf("jump host %s, %s", e.Hop, e.Err)
+}
+
+func (e *JumpError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectError is returned when a server can't be connected, authenticated
+// or verified, it tells connection failures apart from failed operations
+type ConnectError struct {
+	Addr string
+	// Attempts is the number of connection attempts made
+	Attempts int
+	Err      error
+}
+
+func (e *ConnectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// Dialer connects to SSH servers, directly or through the jump hosts listed
+// in their proxyJump. A jump host is dialed once for each identity it is
+// logged in with and its connection shared by every server reached through
+// it with that identity.
+type Dialer struct {
+	mu   sync.Mutex
+	hops map[string]*hop
+}
+
+type hop struct {
+	// chain are the jump hosts up to this one as written in proxyJump
+	chain  string
+	once   sync.Once
+	client *ssh.Client
+	err    error
+}
+
+// NewDialer creates a Dialer, call Close once the servers it dialed are done
+// with to close the jump host connections
+func NewDialer() *Dialer {
+	return &Dialer{
+		hops: map[string]*hop{},
+	}
+}
+
+// Dial connects to the SSH server described by cfg and returns the number of
+// attempts it took to connect to it, errors are returned as *ConnectError
+func (d *Dialer) Dial(ctx context.Context, cfg Config) (*ssh.Client, int, error) {
+	client, attempts, err := d.dial(ctx, cfg)
+	if err != nil {
+		return nil, attempts, &ConnectError{Addr: cfg.Addr, Attempts: attempts, Err: err}
+	}
+	return client, attempts, nil
+}
+
+func (d *Dialer) dial(ctx context.Context, cfg Config) (*ssh.Client, int, error) {
+	specs := ParseProxyJump(cfg.ProxyJump)
+
+	var via *ssh.Client
+	key := identity(cfg)
+	for i, spec := range specs {
+		hopCfg := jumpConfig(cfg, spec)
+		key += "," + hopCfg.Username + "@" + hopCfg.Addr
+		client, err := d.dialHop(ctx, key, strings.Join(specs[:i+1], ","), hopCfg, via)
+		if err != nil {
+			return nil, 0, &JumpError{Hop: spec, Err: err}
+		}
+		via = client
+	}
+
+	if via != nil {
+		verbose.Printf("%s: connecting through %s", cfg.Addr, strings.Join(specs, ","))
+	}
+	return dial(ctx, cfg, via)
+}
+
+// dialHop returns the shared connection of the last jump host of chain,
+// key identifies it with the users and credentials it is reached with
+func (d *Dialer) dialHop(ctx context.Context, key, chain string, cfg Config, via *ssh.Client) (*ssh.Client, error) {
+	d.mu.Lock()
+	h, ok := d.hops[key]
+	if !ok {
+		h = &hop{chain: chain}
+		d.hops[key] = h
+	}
+	d.mu.Unlock()
+
+	h.once.Do(func() {
+		h.client, _, h.err = dial(ctx, cfg, via)
+	})
+	return h.client, h.err
+}
+
+// jumpConfig returns the config of the jump host spec on the way to target,
+// it is logged in with the credentials of the target and its username
+// unless spec has a user
+func jumpConfig(target Config, spec string) Config {
+	cfg := target
+	cfg.ProxyJump = ""
+	cfg.Username, cfg.Addr = parseJumpHost(spec)
+	if cfg.Username == "" {
+		cfg.Username = target.Username
+	}
+	return cfg
+}
+
+// identity returns a digest of what a jump host is authenticated and
+// verified with, targets only share a jump host connection when it matches
+func identity(cfg Config) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q %q %q %q %q %q %q %q", cfg.Password, cfg.PrivateKeyPath, cfg.PrivateKeyPaths,
+		cfg.CertificatePath, cfg.Passphrase, cfg.PassphraseEnv, cfg.AuthMethods, cfg.HostKeyPolicy, cfg.KnownHostsFile)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Close closes the connections of all jump hosts
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var err error
+	for _, h := range d.hops {
+		if h.client == nil {
+			continue
+		}
+		if e := h.client.Close(); e != nil {
+			err = fmt.Errorf("%s; jump host %s close failed, %s", err, h.chain, e)
+		}
+	}
+	return err
+}
+
+// ParseProxyJump splits a comma separated list of jump hosts in the OpenSSH
+// ProxyJump format '[user@]host[:port]', "none" disables jumping.
+func ParseProxyJump(proxyJump string) []string {
+	specs := []string{}
+	if proxyJump == "none" {
+		return specs
+	}
+	for _, spec := range strings.Split(proxyJump, ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// parseJumpHost splits a jump host spec into the user and an address with
+// the default port added
+func parseJumpHost(spec string) (string, string) {
+	var user string
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		user, spec = spec[:i], spec[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(spec); err != nil {
+		spec = net.JoinHostPort(strings.Trim(spec, "[]"), "22")
+	}
+	return user, spec
+}
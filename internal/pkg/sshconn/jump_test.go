@@ -0,0 +1,98 @@
+package sshconn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseProxyJump(t *testing.T) {
+	tests := []struct {
+		proxyJump string
+		want      []string
+	}{
+		{"", []string{}},
+		{"none", []string{}},
+		{"bastion", []string{"bastion"}},
+		{"ops@bastion:2222", []string{"ops@bastion:2222"}},
+		{"a,b", []string{"a", "b"}},
+		{" a , b ,", []string{"a", "b"}},
+		{"a,,b", []string{"a", "b"}},
+		{"none,b", []string{"none", "b"}},
+	}
+	for _, tt := range tests {
+		if got := ParseProxyJump(tt.proxyJump); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseProxyJump(%q) = %q, want %q", tt.proxyJump, got, tt.want)
+		}
+	}
+}
+
+func TestParseJumpHost(t *testing.T) {
+	tests := []struct {
+		spec string
+		user string
+		addr string
+	}{
+		{"bastion", "", "bastion:22"},
+		{"bastion:2222", "", "bastion:2222"},
+		{"ops@bastion", "ops", "bastion:22"},
+		{"ops@bastion:2222", "ops", "bastion:2222"},
+		{"ops@corp.example@bastion", "ops@corp.example", "bastion:22"},
+		{"10.0.0.1", "", "10.0.0.1:22"},
+		{"::1", "", "[::1]:22"},
+		{"[::1]", "", "[::1]:22"},
+		{"ops@[fe80::1]:2222", "ops", "[fe80::1]:2222"},
+	}
+	for _, tt := range tests {
+		user, addr := parseJumpHost(tt.spec)
+		if user != tt.user || addr != tt.addr {
+			t.Errorf("parseJumpHost(%q) = %q, %q, want %q, %q", tt.spec, user, addr, tt.user, tt.addr)
+		}
+	}
+}
+
+func TestJumpConfig(t *testing.T) {
+	target := Config{Addr: "10.0.0.9:22", Username: "root", Password: "pw", ProxyJump: "ops@bastion,gw"}
+	tests := []struct {
+		spec     string
+		username string
+		addr     string
+	}{
+		{"bastion", "root", "bastion:22"},
+		{"ops@bastion:2222", "ops", "bastion:2222"},
+	}
+	for _, tt := range tests {
+		cfg := jumpConfig(target, tt.spec)
+		if cfg.Username != tt.username || cfg.Addr != tt.addr || cfg.ProxyJump != "" || cfg.Password != "pw" {
+			t.Errorf("jumpConfig(%q) = %+v, want user %s at %s with the password of the target", tt.spec, cfg, tt.username, tt.addr)
+		}
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	base := Config{Addr: "10.0.0.1:22", Username: "root", Password: "pw", PrivateKeyPaths: []string{"/keys/a"}}
+	same := []Config{
+		base,
+		{Addr: "10.0.0.2:2222", Username: "ops", Password: "pw", PrivateKeyPaths: []string{"/keys/a"}, Group: "web"},
+	}
+	for _, cfg := range same {
+		if identity(cfg) != identity(base) {
+			t.Errorf("identity(%+v) differs from identity(%+v)", cfg, base)
+		}
+	}
+
+	different := []Config{
+		{Password: "other", PrivateKeyPaths: []string{"/keys/a"}},
+		{Password: "pw"},
+		{Password: "pw", PrivateKeyPaths: []string{"/keys/b"}},
+		{Password: "pw", PrivateKeyPaths: []string{"/keys/a"}, CertificatePath: "/keys/a-cert.pub"},
+		{Password: "pw", PrivateKeyPaths: []string{"/keys/a"}, AuthMethods: []string{"password"}},
+		{Password: "pw", PrivateKeyPaths: []string{"/keys/a"}, HostKeyPolicy: HostKeyInsecure},
+		{Password: "pw", PrivateKeyPaths: []string{"/keys/a"}, KnownHostsFile: "/tmp/known_hosts"},
+		{Password: "pw", PrivateKeyPaths: []string{"/keys/a"}, Passphrase: "secret"},
+	}
+	for _, cfg := range different {
+		if identity(cfg) == identity(base) {
+			t.Errorf("identity(%+v) equals identity(%+v)", cfg, base)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package sshconn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// keyCache holds the keys parsed so far by path, so the passphrase of a key
+// shared by many hosts is asked only once
+var (
+	keyMu    sync.Mutex
+	keyCache = map[string]cachedKey{}
+)
+
+type cachedKey struct {
+	signer ssh.Signer
+	err    error
+}
+
+func loadPrivateKey(cfg Config, path string) (ssh.Signer, error) {
+	// Hold the lock while prompting so concurrent connections wait for the
+	// first answer instead of prompting in parallel.
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	if k, ok := keyCache[path]; ok {
+		return k.signer, k.err
+	}
+
+	signer, err := parsePrivateKey(cfg, path)
+	keyCache[path] = cachedKey{signer: signer, err: err}
+	return signer, err
+}
+
+func parsePrivateKey(cfg Config, path string) (ssh.Signer, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err == nil {
+		return signer, nil
+	}
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, fmt.Errorf("failed to parse private key %s, %s", path, err)
+	}
+
+	passphrase, err := readPassphrase(cfg, path)
+	if err != nil {
+		return nil, fmt.Errorf("private key %s is encrypted, %s", path, err)
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key %s, %s", path, err)
+	}
+	return signer, nil
+}
+
+// readPassphrase looks up the passphrase of an encrypted key, in order from
+// the config, the environment variable named by passphraseEnv, the
+// SSH_ASKPASS helper and finally an interactive prompt on the terminal.
+func readPassphrase(cfg Config, path string) (string, error) {
+	if cfg.Passphrase != "" {
+		return cfg.Passphrase, nil
+	}
+	if cfg.PassphraseEnv != "" {
+		if v, ok := os.LookupEnv(cfg.PassphraseEnv); ok {
+			return v, nil
+		}
+		verbose.Printf("%s: environment variable %s is not set", cfg.Addr, cfg.PassphraseEnv)
+	}
+
+	prompt := fmt.Sprintf("Enter passphrase for key '%s': ", path)
+	if useAskPass() {
+		return askPass(prompt)
+	}
+	return promptTTY(prompt)
+}
+
+// useAskPass follows the SSH_ASKPASS_REQUIRE semantics of OpenSSH: "force"
+// and "prefer" always use the helper, "never" disables it and otherwise it
+// is only used when there is no terminal to prompt on.
+func useAskPass() bool {
+	if os.Getenv("SSH_ASKPASS") == "" {
+		return false
+	}
+	switch os.Getenv("SSH_ASKPASS_REQUIRE") {
+	case "force", "prefer":
+		return true
+	case "never":
+		return false
+	}
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return true
+	}
+	tty.Close()
+	return false
+}
+
+func askPass(prompt string) (string, error) {
+	helper := os.Getenv("SSH_ASKPASS")
+	out, err := exec.Command(helper, prompt).Output()
+	if err != nil {
+		return "", fmt.Errorf("askpass helper %s failed, %s", helper, err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// ReadPassword asks for a secret the way passphrases are asked for, through
+// the SSH_ASKPASS helper or an interactive prompt on the terminal
+func ReadPassword(prompt string) (string, error) {
+	if useAskPass() {
+		return askPass(prompt)
+	}
+	s, err := promptTTY(prompt)
+	if err == errNoTTY {
+		return "", errors.New("no terminal to prompt for the password, set SSH_ASKPASS")
+	}
+	return s, err
+}
+
+var errNoTTY = errors.New("no terminal to prompt for the passphrase, set passphrase, passphraseEnv or SSH_ASKPASS")
+
+// promptTTY reads the passphrase from the controlling terminal rather than
+// stdin, which may be piped to the remote commands.
+func promptTTY(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errNoTTY
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	b, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase, %s", err)
+	}
+	return string(b), nil
+}
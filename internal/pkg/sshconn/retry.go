@@ -0,0 +1,56 @@
+package sshconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// maxRetryDelay caps the exponential backoff between connection attempts
+const maxRetryDelay = 30 * time.Second
+
+// errConnectTimeout is returned when an attempt exceeds the connect timeout
+var errConnectTimeout = errors.New("connect timeout")
+
+// attemptError reports an attempt stopped by its timeout, or by ctx being
+// done
+func attemptError(ctx context.Context, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w after %s", errConnectTimeout, timeout)
+}
+
+// retryable reports whether a failed connection may succeed if tried again.
+// Authentication failures are not retried so accounts don't get locked.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var hkErr *HostKeyError
+	if errors.As(err, &hkErr) {
+		return false
+	}
+	return !strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// backoff returns the delay before the retry following attempt, it doubles
+// from base on every attempt and the upper half is randomised so hosts
+// failing together don't retry together
+func backoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		base = DefaultRetryDelay
+	}
+	delay := base
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
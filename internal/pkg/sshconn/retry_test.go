@@ -0,0 +1,60 @@
+package sshconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		base    time.Duration
+		attempt int
+		max     time.Duration
+	}{
+		{time.Second, 1, time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 3, 4 * time.Second},
+		{time.Second, 5, 16 * time.Second},
+		{time.Second, 6, maxRetryDelay},
+		{time.Second, 100, maxRetryDelay},
+		{0, 1, DefaultRetryDelay},
+		{-time.Second, 2, 2 * DefaultRetryDelay},
+		{100 * time.Millisecond, 3, 400 * time.Millisecond},
+		{time.Minute, 1, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		// The upper half is random, check the bounds a few times
+		for i := 0; i < 20; i++ {
+			got := backoff(tt.base, tt.attempt)
+			if got < tt.max/2 || got > tt.max {
+				t.Errorf("backoff(%s, %d) = %s, want between %s and %s", tt.base, tt.attempt, got, tt.max/2, tt.max)
+				break
+			}
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{context.Background(), errors.New("dial tcp 10.0.0.1:22: connect: connection refused"), true},
+		{context.Background(), fmt.Errorf("failed to connect, %w", errConnectTimeout), true},
+		{context.Background(), errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password]"), false},
+		{context.Background(), fmt.Errorf("failed to connect, %w", &HostKeyError{Addr: "10.0.0.1:22", Key: newTestKey(t)}), false},
+		{cancelled, errors.New("dial tcp 10.0.0.1:22: connect: connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.ctx, tt.err); got != tt.want {
+			t.Errorf("retryable(%q) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package sshconn
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// SSHConfig holds the options of an OpenSSH client configuration file such
+// as ~/.ssh/config. Only the options mapping to Config are kept.
+type SSHConfig struct {
+	entries []sshConfigEntry
+}
+
+type sshConfigEntry struct {
+	// patterns of the Host block the option appears in, empty for options
+	// before the first Host line which apply to every host
+	patterns []string
+	key      string
+	value    string
+}
+
+// sshConfigKeys are the options applied by SSHConfig.Apply, lowercased
+var sshConfigKeys = []string{"hostname", "port", "user", "identityfile", "proxyjump"}
+
+// maxIncludeDepth guards against Include loops
+const maxIncludeDepth = 16
+
+// LoadSSHConfig parses the OpenSSH client config at path and the files it
+// includes. A missing file yields an empty config.
+func LoadSSHConfig(path string) (*SSHConfig, error) {
+	c := &SSHConfig{}
+	path = expandHome(path)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return c, nil
+	}
+	if err := c.parseFile(path, nil, 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *SSHConfig) parseFile(path string, patterns []string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: too many nested includes", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lineNum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		key, args := splitSSHConfigLine(scanner.Text())
+		if key == "" {
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%s:%d: missing argument for %s", path, lineNum, key)
+		}
+
+		switch key {
+		case "host":
+			patterns = args
+		case "match":
+			// Match criteria are not supported, never apply the block
+			patterns = []string{"!*"}
+		case "include":
+			for _, pattern := range args {
+				if err := c.include(pattern, patterns, depth); err != nil {
+					return fmt.Errorf("%s:%d: %s", path, lineNum, err)
+				}
+			}
+		default:
+			if contains(sshConfigKeys, key) {
+				c.entries = append(c.entries, sshConfigEntry{
+					patterns: patterns,
+					key:      key,
+					value:    strings.Join(args, " "),
+				})
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// include parses the files matching pattern, relative paths are resolved
+// against ~/.ssh like OpenSSH does for the user config
+func (c *SSHConfig) include(pattern string, patterns []string, depth int) error {
+	pattern = expandHome(pattern)
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(expandHome("~/.ssh"), pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := c.parseFile(f, patterns, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitSSHConfigLine returns the lowercased keyword and the arguments of a
+// config line, keyword and arguments may be separated by '=' and arguments
+// may be double quoted
+func splitSSHConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), nil
+	}
+	key := strings.ToLower(line[:i])
+	rest := strings.TrimLeft(line[i:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	args := []string{}
+	var cur strings.Builder
+	inQuote, hasArg := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			hasArg = true
+		case (r == ' ' || r == '\t') && !inQuote:
+			if hasArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				hasArg = false
+			}
+		case r == '#' && !inQuote && !hasArg:
+			return key, args
+		default:
+			cur.WriteRune(r)
+			hasArg = true
+		}
+	}
+	if hasArg {
+		args = append(args, cur.String())
+	}
+	return key, args
+}
+
+// lookup returns the values of the options matching host, the first value
+// obtained for an option wins except for IdentityFile which accumulates
+func (c *SSHConfig) lookup(host string) map[string][]string {
+	values := map[string][]string{}
+	for _, e := range c.entries {
+		if !matchHostPatterns(e.patterns, host) {
+			continue
+		}
+		if _, ok := values[e.key]; ok && e.key != "identityfile" {
+			continue
+		}
+		values[e.key] = append(values[e.key], e.value)
+	}
+	return values
+}
+
+// Apply resolves the host alias of cfg.Addr and fills in the fields left
+// empty by cfg. keepUsername prevents the User option from replacing a
+// username given explicitly. Jump hosts are resolved as aliases too.
+func (c *SSHConfig) Apply(cfg Config, keepUsername bool) Config {
+	alias, port, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		alias, port = cfg.Addr, ""
+	}
+
+	values := c.lookup(alias)
+	if len(values) > 0 {
+		hostname := alias
+		if v, ok := values["hostname"]; ok {
+			hostname = expandSSHConfigTokens(v[0], alias, alias, "")
+		}
+		if port == "" {
+			port = "22"
+			if v, ok := values["port"]; ok {
+				port = v[0]
+			}
+		}
+		cfg.Addr = net.JoinHostPort(hostname, port)
+
+		if v, ok := values["user"]; ok && (cfg.Username == "" || !keepUsername) {
+			cfg.Username = v[0]
+		}
+		if v, ok := values["identityfile"]; ok && cfg.PrivateKeyPath == "" && len(cfg.PrivateKeyPaths) == 0 {
+			for _, p := range v {
+				if p == "none" {
+					continue
+				}
+				cfg.PrivateKeyPaths = append(cfg.PrivateKeyPaths, expandSSHConfigTokens(p, alias, hostname, cfg.Username))
+			}
+		}
+		if v, ok := values["proxyjump"]; ok && cfg.ProxyJump == "" {
+			cfg.ProxyJump = v[0]
+		}
+		verbose.Printf("%s: resolved to %s from ssh config", alias, cfg.Addr)
+	}
+
+	if cfg.ProxyJump != "" && cfg.ProxyJump != "none" {
+		hops := []string{}
+		for _, spec := range ParseProxyJump(cfg.ProxyJump) {
+			hops = append(hops, c.resolveJumpHost(spec))
+		}
+		cfg.ProxyJump = strings.Join(hops, ",")
+	}
+	return cfg
+}
+
+// resolveJumpHost resolves the alias of a '[user@]host[:port]' jump host
+func (c *SSHConfig) resolveJumpHost(spec string) string {
+	user, hostport := "", spec
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		user, hostport = spec[:i], spec[i+1:]
+	}
+	alias, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		alias, port = hostport, ""
+	}
+
+	values := c.lookup(alias)
+	if len(values) == 0 {
+		return spec
+	}
+	hostname := alias
+	if v, ok := values["hostname"]; ok {
+		hostname = expandSSHConfigTokens(v[0], alias, alias, "")
+	}
+	if v, ok := values["port"]; ok && port == "" {
+		port = v[0]
+	}
+	if v, ok := values["user"]; ok && user == "" {
+		user = v[0]
+	}
+
+	resolved := hostname
+	if port != "" {
+		resolved = net.JoinHostPort(hostname, port)
+	}
+	if user != "" {
+		resolved = user + "@" + resolved
+	}
+	return resolved
+}
+
+// matchHostPatterns reports whether host matches a Host line, a negated
+// pattern that matches excludes the host whatever the other patterns say
+func matchHostPatterns(patterns []string, host string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	matched := false
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		if negated {
+			p = p[1:]
+		}
+		if !matchWildcard(strings.ToLower(p), strings.ToLower(host)) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// matchWildcard matches s against a pattern where '*' matches any sequence
+// and '?' any single character
+func matchWildcard(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// expandSSHConfigTokens expands '~' and the %% %d %h %n %r %u tokens
+func expandSSHConfigTokens(s, alias, hostname, remoteUser string) string {
+	s = expandHome(s)
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	home, _ := os.UserHomeDir()
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+	r := strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", hostname,
+		"%n", alias,
+		"%r", remoteUser,
+		"%u", localUser,
+	)
+	return r.Replace(s)
+}
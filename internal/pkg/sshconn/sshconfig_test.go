@@ -0,0 +1,285 @@
+package sshconn
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line string
+		key  string
+		args []string
+	}{
+		{"", "", nil},
+		{"   ", "", nil},
+		{"# comment", "", nil},
+		{"  # indented comment", "", nil},
+		{"Host web", "host", []string{"web"}},
+		{"HostName 10.0.0.1", "hostname", []string{"10.0.0.1"}},
+		{"\tPort\t2222", "port", []string{"2222"}},
+		{"Host web db", "host", []string{"web", "db"}},
+		{"Host=web", "host", []string{"web"}},
+		{"Host = web", "host", []string{"web"}},
+		{"Port=2222", "port", []string{"2222"}},
+		{`IdentityFile "~/my keys/id_ed25519"`, "identityfile", []string{"~/my keys/id_ed25519"}},
+		{`IdentityFile="/keys/a b"`, "identityfile", []string{"/keys/a b"}},
+		{`Host "a b" c`, "host", []string{"a b", "c"}},
+		{`User ""`, "user", []string{""}},
+		{"User ops # trailing comment", "user", []string{"ops"}},
+		{`User "ops#1"`, "user", []string{"ops#1"}},
+		{"User ops#1", "user", []string{"ops#1"}},
+		{"Host", "host", nil},
+	}
+	for _, tt := range tests {
+		key, args := splitSSHConfigLine(tt.line)
+		if key != tt.key || (len(args) > 0 || len(tt.args) > 0) && !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("splitSSHConfigLine(%q) = %q, %q, want %q, %q", tt.line, key, args, tt.key, tt.args)
+		}
+	}
+}
+
+func TestMatchHostPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		host     string
+		want     bool
+	}{
+		{nil, "web", true},
+		{[]string{"web"}, "web", true},
+		{[]string{"web"}, "WEB", true},
+		{[]string{"web"}, "web1", false},
+		{[]string{"web*"}, "web1", true},
+		{[]string{"web?"}, "web12", false},
+		{[]string{"*"}, "anything", true},
+		{[]string{"db", "web*"}, "web1", true},
+		{[]string{"*", "!db*"}, "web1", true},
+		{[]string{"*", "!db*"}, "db1", false},
+		{[]string{"!db*", "*"}, "db1", false},
+		{[]string{"!db*"}, "web1", false},
+		{[]string{"!*"}, "web1", false},
+	}
+	for _, tt := range tests {
+		if got := matchHostPatterns(tt.patterns, tt.host); got != tt.want {
+			t.Errorf("matchHostPatterns(%q, %q) = %v, want %v", tt.patterns, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "abc", true},
+		{"a*c", "abc", true},
+		{"a*c", "ac", true},
+		{"a*c", "abd", false},
+		{"?", "", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*.example.com", "web.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"10.0.*.1", "10.0.3.1", true},
+		{"**", "x", true},
+	}
+	for _, tt := range tests {
+		if got := matchWildcard(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchWildcard(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+// writeSSHConfig writes the lines of a config file into dir
+func writeSSHConfig(t *testing.T, dir, name string, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSSHConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeSSHConfig(t, dir, "web.conf",
+		"Host web",
+		"  HostName 10.0.0.1",
+	)
+	path := writeSSHConfig(t, dir, "config",
+		"Include "+filepath.Join(dir, "*.conf"),
+		"Host db",
+		"  HostName 10.0.0.2",
+	)
+	c, err := LoadSSHConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for alias, want := range map[string]string{"web": "10.0.0.1:22", "db": "10.0.0.2:22"} {
+		if got := c.Apply(Config{Addr: alias}, false).Addr; got != want {
+			t.Errorf("Apply(%s).Addr = %q, want %q", alias, got, want)
+		}
+	}
+
+	loop := writeSSHConfig(t, dir, "loop", "Include "+filepath.Join(dir, "loop"))
+	if _, err := LoadSSHConfig(loop); err == nil || !strings.Contains(err.Error(), "too many nested includes") {
+		t.Errorf("LoadSSHConfig of an include loop error %v, want too many nested includes", err)
+	}
+
+	if _, err := LoadSSHConfig(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("LoadSSHConfig of a missing file error %s", err)
+	}
+
+	bad := writeSSHConfig(t, dir, "bad", "Host web", "  HostName")
+	if _, err := LoadSSHConfig(bad); err == nil {
+		t.Errorf("LoadSSHConfig of a missing argument succeeded")
+	}
+}
+
+func TestSSHConfigApply(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	path := writeSSHConfig(t, dir, "config",
+		"Host web",
+		"  HostName 10.0.0.1",
+		"  Port 2222",
+		"  User deploy",
+		`  IdentityFile "~/.ssh/web key"`,
+		"  ProxyJump bastion",
+		"Host bastion",
+		"  HostName=bastion.example.com",
+		"  User jump",
+		"Host *.internal !db.internal",
+		"  HostName %h.example.com",
+		"  IdentityFile none",
+		"Host *",
+		"  User fallback",
+		"  IdentityFile ~/.ssh/id_ed25519",
+	)
+	c, err := LoadSSHConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		cfg          Config
+		keepUsername bool
+		want         Config
+	}{
+		{
+			name: "alias",
+			cfg:  Config{Addr: "web", Username: "root"},
+			want: Config{
+				Addr:            "10.0.0.1:2222",
+				Username:        "deploy",
+				PrivateKeyPaths: []string{filepath.Join(dir, ".ssh/web key"), filepath.Join(dir, ".ssh/id_ed25519")},
+				ProxyJump:       "jump@bastion.example.com",
+			},
+		},
+		{
+			name:         "explicit port and username",
+			cfg:          Config{Addr: "web:22", Username: "root"},
+			keepUsername: true,
+			want: Config{
+				Addr:            "10.0.0.1:22",
+				Username:        "root",
+				PrivateKeyPaths: []string{filepath.Join(dir, ".ssh/web key"), filepath.Join(dir, ".ssh/id_ed25519")},
+				ProxyJump:       "jump@bastion.example.com",
+			},
+		},
+		{
+			name: "explicit keys and jump",
+			cfg:  Config{Addr: "web", PrivateKeyPaths: []string{"/keys/a"}, ProxyJump: "none"},
+			want: Config{
+				Addr:            "10.0.0.1:2222",
+				Username:        "deploy",
+				PrivateKeyPaths: []string{"/keys/a"},
+				ProxyJump:       "none",
+			},
+		},
+		{
+			name: "hostname token and identity none",
+			cfg:  Config{Addr: "app.internal"},
+			want: Config{
+				Addr:            "app.internal.example.com:22",
+				Username:        "fallback",
+				PrivateKeyPaths: []string{filepath.Join(dir, ".ssh/id_ed25519")},
+			},
+		},
+		{
+			name: "negated pattern",
+			cfg:  Config{Addr: "db.internal:22"},
+			want: Config{
+				Addr:            "db.internal:22",
+				Username:        "fallback",
+				PrivateKeyPaths: []string{filepath.Join(dir, ".ssh/id_ed25519")},
+			},
+		},
+		{
+			name:         "jump hosts given as aliases",
+			cfg:          Config{Addr: "10.0.0.9:22", Username: "root", ProxyJump: "ops@bastion:2200,web"},
+			keepUsername: true,
+			want: Config{
+				Addr:            "10.0.0.9:22",
+				Username:        "root",
+				PrivateKeyPaths: []string{filepath.Join(dir, ".ssh/id_ed25519")},
+				ProxyJump:       "ops@bastion.example.com:2200,deploy@10.0.0.1:2222",
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := c.Apply(tt.cfg, tt.keepUsername)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Apply() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	empty := &SSHConfig{}
+	cfg := Config{Addr: "web", Username: "root"}
+	if got := empty.Apply(cfg, false); !reflect.DeepEqual(got, cfg) {
+		t.Errorf("empty Apply() = %+v, want %+v", got, cfg)
+	}
+}
+
+func TestResolveJumpHost(t *testing.T) {
+	dir := t.TempDir()
+	path := writeSSHConfig(t, dir, "config",
+		"Host bastion",
+		"  HostName bastion.example.com",
+		"  Port 2200",
+		"  User jump",
+		"Host gw",
+		"  HostName 10.0.0.254",
+	)
+	c, err := LoadSSHConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"bastion", "jump@bastion.example.com:2200"},
+		{"ops@bastion", "ops@bastion.example.com:2200"},
+		{"bastion:22", "jump@bastion.example.com:22"},
+		{"ops@bastion:22", "ops@bastion.example.com:22"},
+		{"gw", "10.0.0.254"},
+		{"gw:2222", "10.0.0.254:2222"},
+		{"other", "other"},
+		{"ops@other:2222", "ops@other:2222"},
+	}
+	for _, tt := range tests {
+		if got := c.resolveJumpHost(tt.spec); got != tt.want {
+			t.Errorf("resolveJumpHost(%q) = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
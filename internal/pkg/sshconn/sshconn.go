@@ -0,0 +1,201 @@
+package sshconn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Config describes how to connect to a single SSH server, it is shared by
+// rssh and rsftp so both tools authenticate and verify hosts the same way.
+type Config struct {
+	Addr            string   `json:"addr" mapstructure:"addr"`
+	Group           string   `json:"group" mapstructure:"group"`
+	Username        string   `json:"username" mapstructure:"username"`
+	Password        string   `json:"password" mapstructure:"password"`
+	PrivateKeyPath  string   `json:"privateKeyPath" mapstructure:"privateKeyPath"`
+	PrivateKeyPaths []string `json:"privateKeyPaths" mapstructure:"privateKeyPaths"`
+	CertificatePath string   `json:"certificatePath" mapstructure:"certificatePath"`
+	Passphrase      string   `json:"passphrase" mapstructure:"passphrase"`
+	PassphraseEnv   string   `json:"passphraseEnv" mapstructure:"passphraseEnv"`
+	AuthMethods     []string `json:"authMethods" mapstructure:"authMethods"`
+	HostKeyPolicy   string   `json:"hostKeyPolicy" mapstructure:"hostKeyPolicy"`
+	KnownHostsFile  string   `json:"knownHostsFile" mapstructure:"knownHostsFile"`
+	ProxyJump       string   `json:"proxyJump" mapstructure:"proxyJump"`
+	// ConnectTimeout bounds the TCP connection and the SSH handshake of each
+	// attempt, DefaultConnectTimeout is used when it is 0
+	ConnectTimeout time.Duration `json:"connectTimeout" mapstructure:"connectTimeout"`
+	// Retries is the number of times a failed connection is retried, auth
+	// and host key failures are never retried. nil is unset, so that a host
+	// of the configuration file can set 0 against --retries.
+	Retries *int `json:"retries" mapstructure:"retries"`
+	// RetryDelay is the delay before the first retry, it doubles on every
+	// retry. DefaultRetryDelay is used when it is 0.
+	RetryDelay time.Duration `json:"retryDelay" mapstructure:"retryDelay"`
+	// Become runs commands and file transfers as BecomeUser with
+	// BecomeMethod, BecomePassword answers the sudo or su password prompt.
+	// BecomePty runs sudo on a terminal. Like Retries, nil is unset.
+	Become         *bool  `json:"become" mapstructure:"become"`
+	BecomeUser     string `json:"becomeUser" mapstructure:"becomeUser"`
+	BecomeMethod   string `json:"becomeMethod" mapstructure:"becomeMethod"`
+	BecomePassword string `json:"becomePassword" mapstructure:"becomePassword"`
+	BecomePty      *bool  `json:"becomePty" mapstructure:"becomePty"`
+}
+
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultRetryDelay     = time.Second
+)
+
+// verbose logs connection details, it is silent unless SetVerbose is called
+var verbose = log.New(io.Discard, "", log.LstdFlags)
+
+// SetVerbose enables logging of connection details to w
+func SetVerbose(w io.Writer) {
+	verbose.SetOutput(w)
+}
+
+// newClientConfig builds the ssh.ClientConfig for cfg. The returned verifier
+// records host key failures so they can be reported after the handshake.
+func newClientConfig(cfg Config) (*ssh.ClientConfig, *HostKeyVerifier, *authChain, error) {
+	verifier, err := NewHostKeyVerifier(cfg.HostKeyPolicy, cfg.KnownHostsFile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	chain, methods, err := newAuthChain(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:              cfg.Username,
+		Auth:              methods,
+		HostKeyCallback:   verifier.Callback,
+		HostKeyAlgorithms: verifier.HostKeyAlgorithms(cfg.Addr),
+	}
+
+	return sshConfig, verifier, chain, nil
+}
+
+// CheckConfig returns the error cfg fails to connect with before any network
+// I/O, such as missing credentials, an unreadable key or certificate or an
+// unusable known_hosts setup
+func CheckConfig(cfg Config) error {
+	_, _, _, err := newClientConfig(cfg)
+	return err
+}
+
+// dial connects to the SSH server described by cfg, through via when it is
+// not nil. Failed connections are retried as configured by cfg, the number
+// of attempts made is returned.
+func dial(ctx context.Context, cfg Config, via *ssh.Client) (*ssh.Client, int, error) {
+	sshConfig, verifier, chain, err := newClientConfig(cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	timeout := cfg.ConnectTimeout
+	if timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+
+	verbose.Printf("%s: auth chain %s", cfg.Addr, chain)
+	for attempt := 1; ; attempt++ {
+		sshClient, err := connect(ctx, via, cfg.Addr, sshConfig, timeout)
+		if err == nil {
+			verbose.Printf("%s: authenticated with %s", cfg.Addr, chain.Used())
+			return sshClient, attempt, nil
+		}
+
+		// The ssh package flattens callback errors into a string, return the
+		// typed host key error instead so callers can tell it apart.
+		if hkErr := verifier.Err(); hkErr != nil {
+			return nil, attempt, hkErr
+		}
+		err = fmt.Errorf("failed to connect %s, %w", cfg.Addr, err)
+		if cfg.Retries == nil || attempt > *cfg.Retries || !retryable(ctx, err) {
+			return nil, attempt, err
+		}
+
+		delay := backoff(cfg.RetryDelay, attempt)
+		verbose.Printf("%s: attempt %d failed, retrying in %s, %s", cfg.Addr, attempt, delay.Round(time.Millisecond), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, attempt, err
+		}
+	}
+}
+
+type dialResult struct {
+	client *ssh.Client
+	err    error
+}
+
+// connect makes a single connection attempt bounded by timeout
+func connect(ctx context.Context, via *ssh.Client, addr string, sshConfig *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan dialResult, 1)
+	go func() {
+		client, err := handshake(attemptCtx, via, addr, sshConfig)
+		done <- dialResult{client: client, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil && attemptCtx.Err() != nil {
+			return nil, attemptError(ctx, timeout)
+		}
+		return r.client, r.err
+	case <-attemptCtx.Done():
+		// Dialing through a jump host can't be interrupted, drop the
+		// connection if it is made after all
+		go func() {
+			if r := <-done; r.client != nil {
+				r.client.Close()
+			}
+		}()
+		return nil, attemptError(ctx, timeout)
+	}
+}
+
+// handshake opens a connection to addr and runs the SSH handshake on it,
+// the connection is closed when ctx is done
+func handshake(ctx context.Context, via *ssh.Client, addr string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if via == nil {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = via.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
@@ -2,8 +2,9 @@ package rcp
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"sshtools/internal/pkg/cli"
+	"sshtools/internal/pkg/output"
 	"sshtools/internal/pkg/rsftp"
 	"sshtools/pkg/version"
 	"strings"
@@ -14,24 +15,49 @@ import (
 	"github.com/spf13/viper"
 )
 
-func initConfig() {
+func initConfig() error {
 	if cfgFile == "" {
-		return
+		return nil
 	}
 	viper.SetConfigFile(cfgFile)
 
 	if err := viper.ReadInConfig(); err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to read config file %s, %s", cfgFile, err)
 	}
+	return nil
 }
 
 func addCliFlags(flags *pflag.FlagSet) {
+	cli.AddFlags(flags)
 	flags.StringP("addrs", "a", "", "'host:port,host:port,...', The ssh server addresses")
-	flags.StringP("username", "u", "root", "The ssh server username")
-	flags.StringP("password", "p", "", "The ssh server password")
 	flags.StringP("localpath", "l", "", "Local file or directory")
 	flags.StringP("remotepath", "r", "", "Remote file or directory")
+	flags.String("verify", "", fmt.Sprintf("Verify every transferred file with a checksum, one of %s. The local checksum is computed while streaming, the remote one with a command on the server or by reading the file back", strings.Join(rsftp.ChecksumAlgorithms, "|")))
+	flags.Bool("preserve", false, "Preserve the mode, modification and access times of files and directories. Unlike scp it has no -p shorthand, which is taken by '--password'")
+	flags.String("chmod", "", "Set the octal mode of transferred files, such as 0644. Directories get execute bits where the mode has read bits")
+	flags.String("chown", "", "'user:group', Set the owner of transferred files and directories, either may be omitted and both may be names or ids")
+}
+
+// addCopyFlags adds the flags of the commands which copy files
+// unconditionally, sync decides by itself which files to overwrite
+func addCopyFlags(flags *pflag.FlagSet) {
 	flags.Bool("force", false, "Force overwriting of files that already exist")
+	flags.Bool("resume", false, "Continue files partially transferred before from where they stopped, resumed files are verified with a sha256 checksum. The flag is mutually exclusive with other flag '--force'")
+}
+
+// hostConfigs returns the hosts of the run like cli.HostConfigs, rejecting
+// become settings file transfers don't support
+func hostConfigs() ([]rsftp.ClientConfig, error) {
+	cfgs, err := cli.HostConfigs()
+	if err != nil {
+		return nil, err
+	}
+	for _, cfg := range cfgs {
+		if err := rsftp.CheckBecome(cfg); err != nil {
+			return nil, fmt.Errorf("Host %s: %s", cfg.Addr, err)
+		}
+	}
+	return cfgs, nil
 }
 
 func printVersionAndExist() {
@@ -55,49 +81,89 @@ func prettyPrint(resps []rsftp.Response) {
 
 	for _, resp := range resps {
 		if resp.Err != nil {
-			failed.Printf(">>> %s\n", resp.Addr)
+			failed.Printf(">>> %s%s\n", resp.Addr, cli.AttemptsNote(resp.Attempts))
 			fmt.Printf("Error: %s\n", resp.Err)
 		} else {
-			success.Printf(">>> %s\n", resp.Addr)
+			success.Printf(">>> %s%s\n", resp.Addr, cli.AttemptsNote(resp.Attempts))
 			fmt.Printf("Output: %s\n", resp.Output)
 		}
 		fmt.Println()
 	}
 }
 
-func getClientConfigs() ([]rsftp.ClientConfig, error) {
-	cfgs := []rsftp.ClientConfig{}
-
-	addrs := viper.Get("addrs")
-	v, ok := addrs.(string)
-	if ok {
-		l := strings.Split(v, ",")
-		for _, addr := range l {
-			cfg := rsftp.ClientConfig{
-				Addr:     addr,
-				Username: viper.GetString("username"),
-				Password: viper.GetString("password"),
-			}
-			cfgs = append(cfgs, cfg)
+// toResults converts responses to the machine readable results
+func toResults(resps []rsftp.Response) []output.Result {
+	results := []output.Result{}
+	for _, resp := range resps {
+		r := output.NewResult(resp.Addr, resp.Err, cli.Unreachable(resp.Err), resp.Duration)
+		r.Output = resp.Output
+		r.Bytes = resp.Bytes
+		r.Attempts = resp.Attempts
+		if resp.Err != nil {
+			r.ExitStatus = -1
 		}
-	} else {
-		viper.UnmarshalKey("addrs", &cfgs)
+		results = append(results, r)
 	}
+	return results
+}
 
-	for i, v := range cfgs {
-		addrS := strings.Split(v.Addr, ":")
-		if len(addrS) == 2 {
-			continue
+// getTransferOptions returns the transfer options of the command line
+func getTransferOptions() (rsftp.TransferOptions, error) {
+	opts := rsftp.TransferOptions{
+		Force:    viper.GetBool("force"),
+		Resume:   viper.GetBool("resume"),
+		Verify:   viper.GetString("verify"),
+		Preserve: viper.GetBool("preserve"),
+		Checksum: viper.GetBool("checksum"),
+		Delete:   viper.GetBool("delete"),
+		Timeout:  viper.GetDuration("timeout"),
+	}
+	if opts.Verify != "" {
+		if err := rsftp.ValidateChecksum(opts.Verify); err != nil {
+			return opts, err
 		}
-		if len(addrS) == 1 {
-			defaultPort := "22"
-			addr := fmt.Sprintf("%s:%s", addrS[0], defaultPort)
-			v.Addr = addr
-			cfgs[i] = v
-			continue
+	}
+	if s := viper.GetString("chmod"); s != "" {
+		mode, err := rsftp.ParseMode(s)
+		if err != nil {
+			return opts, err
 		}
-		return nil, fmt.Errorf("Host addr %s is incorrect", v.Addr)
+		opts.Chmod = mode
 	}
+	if s := viper.GetString("chown"); s != "" {
+		owner, err := rsftp.ParseOwner(s)
+		if err != nil {
+			return opts, err
+		}
+		opts.Chown = owner
+	}
+	return opts, nil
+}
 
-	return cfgs, nil
+// newPrinter returns the function printing responses in format
+func newPrinter(format string) (func([]rsftp.Response), error) {
+	if err := output.ValidateFormat(format); err != nil {
+		return nil, err
+	}
+	if format == output.Text {
+		return prettyPrint, nil
+	}
+	return func(resps []rsftp.Response) {
+		if err := output.Print(os.Stdout, format, toResults(resps)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}, nil
+}
+
+// resultError returns the error carrying the exit code of the run
+func resultError(resps []rsftp.Response) error {
+	errs := []error{}
+	failed := 0
+	for _, resp := range resps {
+		errs = append(errs, resp.Err)
+		if resp.Err != nil {
+			failed++
+		}
+	}
+	return cli.ResultError(errs, failed)
 }
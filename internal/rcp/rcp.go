@@ -10,7 +10,6 @@ var (
 )
 
 func NewRCopyCommand() *cobra.Command {
-	cobra.OnInitialize(initConfig)
 	cmd := &cobra.Command{
 		Use:          "rcp",
 		Short:        "Copy files form/to multiple SSH server",
@@ -25,6 +24,7 @@ func NewRCopyCommand() *cobra.Command {
 
 	cmd.AddCommand(NewUploadCommand())
 	cmd.AddCommand(NewDownloadCommand())
+	cmd.AddCommand(NewSyncCommand())
 
 	checkArgs(cmd)
 	return cmd
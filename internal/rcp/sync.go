@@ -0,0 +1,89 @@
+package rcp
+
+import (
+	"fmt"
+	"os"
+	"sshtools/internal/pkg/cli"
+	"sshtools/internal/pkg/exitcode"
+	"sshtools/internal/pkg/rsftp"
+	"sshtools/internal/pkg/sshconn"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func NewSyncCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "sync",
+		Short:        "Sync files to multiple SSH server, only the changed ones are transferred",
+		SilenceUsage: true,
+		RunE:         runSync,
+		Args: func(cmd *cobra.Command, args []string) error {
+			for _, arg := range args {
+				if len(arg) > 0 {
+					return fmt.Errorf("%q does not take any arguments, got %q", cmd.CommandPath(), args)
+				}
+			}
+			return nil
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&cfgFile, "config", "c", "", "The ssh server configuration file")
+	addCliFlags(flags)
+	flags.Bool("checksum", false, "Compare files by checksum instead of size and modification time, the checksum algorithm is the one of '--verify', sha256 by default")
+	flags.Bool("delete", false, "Delete remote files and directories which don't exist locally")
+	cmd.MarkPersistentFlagRequired("localpath")
+	cmd.MarkPersistentFlagRequired("remotepath")
+	cmd.MarkFlagsMutuallyExclusive("addrs", "config")
+
+	return cmd
+}
+
+func runSync(cmd *cobra.Command, args []string) error {
+	if err := viper.BindPFlags(cmd.Flags()); err != nil {
+		return exitcode.New(exitcode.Usage, err)
+	}
+	if err := initConfig(); err != nil {
+		return exitcode.New(exitcode.Usage, err)
+	}
+	if viper.GetBool("verbose") {
+		sshconn.SetVerbose(os.Stderr)
+	}
+
+	printResps, err := newPrinter(viper.GetString("output"))
+	if err != nil {
+		return exitcode.New(exitcode.Usage, err)
+	}
+	opts, err := getTransferOptions()
+	if err != nil {
+		return exitcode.New(exitcode.Usage, err)
+	}
+
+	cfgs, err := hostConfigs()
+	if err != nil {
+		return exitcode.New(exitcode.Usage, err)
+	}
+
+	p, err := cli.NewPool()
+	if err != nil {
+		return exitcode.New(exitcode.Usage, err)
+	}
+
+	ctx, cancel := cli.NewContext()
+	defer cancel()
+
+	mc, failed := rsftp.NewMultiClient(ctx, cfgs, p)
+	defer mc.Close()
+	if err := cli.CheckConnected(len(cfgs), len(failed)); err != nil {
+		printResps(failed)
+		return exitcode.New(exitcode.Unreachable, err)
+	}
+
+	localPath := viper.GetString("localpath")
+	remotePath := viper.GetString("remotepath")
+	resps := append(failed, mc.SyncFiles(ctx, localPath, remotePath, opts)...)
+	printResps(resps)
+
+	return resultError(resps)
+}
@@ -2,8 +2,11 @@ package rcp
 
 import (
 	"fmt"
-	"log"
+	"os"
+	"sshtools/internal/pkg/cli"
+	"sshtools/internal/pkg/exitcode"
 	"sshtools/internal/pkg/rsftp"
+	"sshtools/internal/pkg/sshconn"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -28,34 +31,59 @@ func NewUploadCommand() *cobra.Command {
 	flags := cmd.Flags()
 	flags.StringVarP(&cfgFile, "config", "c", "", "The ssh server configuration file")
 	addCliFlags(flags)
+	addCopyFlags(flags)
 	cmd.MarkPersistentFlagRequired("localpath")
 	cmd.MarkPersistentFlagRequired("remotepath")
 	cmd.MarkFlagsMutuallyExclusive("addrs", "config")
+	cmd.MarkFlagsMutuallyExclusive("force", "resume")
 
 	return cmd
 }
 
 func runUpload(cmd *cobra.Command, args []string) error {
 	if err := viper.BindPFlags(cmd.Flags()); err != nil {
-		log.Fatal(err)
+		return exitcode.New(exitcode.Usage, err)
+	}
+	if err := initConfig(); err != nil {
+		return exitcode.New(exitcode.Usage, err)
+	}
+	if viper.GetBool("verbose") {
+		sshconn.SetVerbose(os.Stderr)
+	}
+
+	printResps, err := newPrinter(viper.GetString("output"))
+	if err != nil {
+		return exitcode.New(exitcode.Usage, err)
+	}
+	opts, err := getTransferOptions()
+	if err != nil {
+		return exitcode.New(exitcode.Usage, err)
 	}
 
-	cfgs, err := getClientConfigs()
+	cfgs, err := hostConfigs()
 	if err != nil {
-		log.Fatal(err)
+		return exitcode.New(exitcode.Usage, err)
 	}
 
-	mc, err := rsftp.NewMultiClient(cfgs)
+	p, err := cli.NewPool()
 	if err != nil {
-		log.Fatal(err)
+		return exitcode.New(exitcode.Usage, err)
 	}
+
+	ctx, cancel := cli.NewContext()
+	defer cancel()
+
+	mc, failed := rsftp.NewMultiClient(ctx, cfgs, p)
 	defer mc.Close()
+	if err := cli.CheckConnected(len(cfgs), len(failed)); err != nil {
+		printResps(failed)
+		return exitcode.New(exitcode.Unreachable, err)
+	}
 
 	localPath := viper.GetString("localpath")
 	remotePath := viper.GetString("remotepath")
-	force := viper.GetBool("force")
-	resps := mc.UploadFiles(localPath, remotePath, force)
-	prettyPrint(resps)
+	resps := append(failed, mc.UploadFiles(ctx, localPath, remotePath, opts)...)
+	printResps(resps)
 
-	return nil
+	return resultError(resps)
 }
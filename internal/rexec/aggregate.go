@@ -0,0 +1,179 @@
+package rexec
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sshtools/internal/pkg/rssh"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// outputGroup holds the hosts which printed the same stdout and stderr and
+// exited with the same status
+type outputGroup struct {
+	exitStatus int
+	signal     string
+	stdout     string
+	stderr     string
+	resps      []rssh.Response
+}
+
+// aggregatePrint prints hosts with identical output and exit status as one
+// block, like dshbak -c does. The largest groups come first so the outliers
+// are printed last.
+func aggregatePrint(resps []rssh.Response) {
+	success := color.New(color.FgGreen)
+	failed := color.New(color.FgRed)
+
+	groups := []*outputGroup{}
+	index := map[string]*outputGroup{}
+	for _, resp := range resps {
+		key := fmt.Sprintf("%d\x00%s\x00%s\x00%s", resp.ExitStatus, resp.Signal, resp.Stdout, resp.Stderr)
+		g, ok := index[key]
+		if !ok {
+			g = &outputGroup{exitStatus: resp.ExitStatus, signal: resp.Signal, stdout: resp.Stdout, stderr: resp.Stderr}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.resps = append(g.resps, resp)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].resps) > len(groups[j].resps)
+	})
+
+	for _, g := range groups {
+		addrs := []string{}
+		for _, resp := range g.resps {
+			addrs = append(addrs, resp.Addr)
+		}
+		header := fmt.Sprintf(">>> %s (%d)", compactHosts(addrs), len(addrs))
+		switch {
+		case g.signal != "":
+			failed.Printf("%s killed by signal %s\n", header, g.signal)
+		case g.exitStatus == 0:
+			success.Println(header)
+		case g.exitStatus < 0:
+			failed.Printf("%s not run\n", header)
+		default:
+			failed.Printf("%s exit status %d\n", header, g.exitStatus)
+		}
+
+		if g.stdout != "" {
+			fmt.Println(strings.TrimSuffix(g.stdout, "\n"))
+		}
+		if g.stderr != "" {
+			fmt.Printf("[stderr]\n%s\n", strings.TrimSuffix(g.stderr, "\n"))
+		}
+		// Errors other than the exit status usually differ from host to host
+		for _, resp := range g.resps {
+			if resp.Err != nil && resp.ExitStatus < 0 {
+				fmt.Printf("%s: %s\n", resp.Addr, resp.Err)
+			}
+			if resp.KeptScript != "" {
+				fmt.Printf("%s: script kept at %s\n", resp.Addr, resp.KeptScript)
+			}
+		}
+		fmt.Println()
+	}
+}
+
+// hostNumber splits an address such as web03:22 into the part before the
+// last number of the host, the number itself and the rest
+type hostNumber struct {
+	prefix, digits, suffix string
+	n                      int
+}
+
+func splitHostNumber(addr string) (hostNumber, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	suffix := ""
+	if err != nil {
+		host = addr
+	} else {
+		suffix = ":" + port
+	}
+
+	// IPv6 addresses are left as they are, they would lose their brackets
+	if strings.Contains(host, ":") {
+		return hostNumber{}, false
+	}
+	end := strings.LastIndexAny(host, "0123456789") + 1
+	if end == 0 {
+		return hostNumber{}, false
+	}
+	start := end
+	for start > 0 && host[start-1] >= '0' && host[start-1] <= '9' {
+		start--
+	}
+	n, err := strconv.Atoi(host[start:end])
+	if err != nil {
+		return hostNumber{}, false
+	}
+	return hostNumber{prefix: host[:start], digits: host[start:end], suffix: host[end:] + suffix, n: n}, true
+}
+
+// compactHosts folds addresses differing only in their last number into the
+// range notation of pdsh, e.g. web[01-03,07]:22
+func compactHosts(addrs []string) string {
+	type run struct{ first, last hostNumber }
+	keys := []string{}
+	numbers := map[string][]hostNumber{}
+	plain := []string{}
+	for _, addr := range addrs {
+		h, ok := splitHostNumber(addr)
+		if !ok {
+			plain = append(plain, addr)
+			continue
+		}
+		key := h.prefix + "\x00" + h.suffix
+		if _, ok := numbers[key]; !ok {
+			keys = append(keys, key)
+		}
+		numbers[key] = append(numbers[key], h)
+	}
+
+	sort.Strings(keys)
+	folded := []string{}
+	for _, key := range keys {
+		hs := numbers[key]
+		sort.Slice(hs, func(i, j int) bool { return hs[i].n < hs[j].n })
+
+		runs := []run{}
+		for _, h := range hs {
+			if len(runs) > 0 {
+				last := &runs[len(runs)-1]
+				// Zero padded numbers only join numbers of the same width
+				padded := strings.HasPrefix(h.digits, "0") || strings.HasPrefix(last.last.digits, "0")
+				if h.n == last.last.n+1 && (!padded || len(h.digits) == len(last.last.digits)) {
+					last.last = h
+					continue
+				}
+				if h.digits == last.last.digits {
+					continue
+				}
+			}
+			runs = append(runs, run{first: h, last: h})
+		}
+
+		if len(runs) == 1 && runs[0].first.n == runs[0].last.n {
+			h := runs[0].first
+			folded = append(folded, h.prefix+h.digits+h.suffix)
+			continue
+		}
+		ranges := []string{}
+		for _, r := range runs {
+			if r.first.n == r.last.n {
+				ranges = append(ranges, r.first.digits)
+			} else {
+				ranges = append(ranges, r.first.digits+"-"+r.last.digits)
+			}
+		}
+		folded = append(folded, fmt.Sprintf("%s[%s]%s", hs[0].prefix, strings.Join(ranges, ","), hs[0].suffix))
+	}
+
+	sort.Strings(plain)
+	return strings.Join(append(folded, plain...), ",")
+}
@@ -0,0 +1,58 @@
+package rexec
+
+import (
+	"testing"
+)
+
+func TestSplitHostNumber(t *testing.T) {
+	tests := []struct {
+		addr string
+		want hostNumber
+		ok   bool
+	}{
+		{"web03:22", hostNumber{prefix: "web", digits: "03", suffix: ":22", n: 3}, true},
+		{"web3", hostNumber{prefix: "web", digits: "3", n: 3}, true},
+		{"web12.example.com:2222", hostNumber{prefix: "web", digits: "12", suffix: ".example.com:2222", n: 12}, true},
+		{"rack1-node4:22", hostNumber{prefix: "rack1-node", digits: "4", suffix: ":22", n: 4}, true},
+		{"10.0.0.7:22", hostNumber{prefix: "10.0.0.", digits: "7", suffix: ":22", n: 7}, true},
+		{"db:22", hostNumber{}, false},
+		{"db", hostNumber{}, false},
+		{"[::1]:22", hostNumber{}, false},
+		{"[fe80::1]:22", hostNumber{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := splitHostNumber(tt.addr)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("splitHostNumber(%q) = %+v, %v, want %+v, %v", tt.addr, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCompactHosts(t *testing.T) {
+	tests := []struct {
+		addrs []string
+		want  string
+	}{
+		{[]string{"web1:22"}, "web1:22"},
+		{[]string{"web1:22", "web2:22", "web3:22"}, "web[1-3]:22"},
+		{[]string{"web3:22", "web1:22", "web2:22"}, "web[1-3]:22"},
+		{[]string{"web1:22", "web2:22", "web4:22"}, "web[1-2,4]:22"},
+		{[]string{"web01:22", "web02:22", "web03:22", "web07:22"}, "web[01-03,07]:22"},
+		{[]string{"web09:22", "web10:22", "web11:22"}, "web[09-11]:22"},
+		{[]string{"web9:22", "web10:22"}, "web[9-10]:22"},
+		{[]string{"web099:22", "web100:22"}, "web[099-100]:22"},
+		{[]string{"web99:22", "web0100:22"}, "web[99,0100]:22"},
+		{[]string{"web1:22", "web1:22"}, "web1:22"},
+		{[]string{"web1:22", "web2:2222"}, "web1:22,web2:2222"},
+		{[]string{"web1:22", "web2:22", "db1:22", "db2:22"}, "db[1-2]:22,web[1-2]:22"},
+		{[]string{"db:22", "api:22", "web1:22", "web2:22"}, "web[1-2]:22,api:22,db:22"},
+		{[]string{"10.0.0.1:22", "10.0.0.2:22", "10.0.0.3:22"}, "10.0.0.[1-3]:22"},
+		{[]string{"[::1]:22", "[::2]:22"}, "[::1]:22,[::2]:22"},
+		{[]string{}, ""},
+	}
+	for _, tt := range tests {
+		if got := compactHosts(tt.addrs); got != tt.want {
+			t.Errorf("compactHosts(%q) = %q, want %q", tt.addrs, got, tt.want)
+		}
+	}
+}
@@ -2,11 +2,16 @@ package rexec
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"regexp"
+	"sshtools/internal/pkg/cli"
+	"sshtools/internal/pkg/output"
 	"sshtools/internal/pkg/rssh"
 	"sshtools/pkg/version"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
@@ -14,22 +19,31 @@ import (
 	"github.com/spf13/viper"
 )
 
-func initConfig() {
+func initConfig() error {
 	if cfgFile == "" {
-		return
+		return nil
 	}
 	viper.SetConfigFile(cfgFile)
 
 	if err := viper.ReadInConfig(); err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to read config file %s, %s", cfgFile, err)
 	}
+	return nil
 }
 
 func addCliFlags(flags *pflag.FlagSet) {
+	cli.AddFlags(flags)
 	flags.StringP("addrs", "a", "", "'host:port,host:port,...', The ssh server addresses, the falg is mutually exclusive with other flag '--config'")
-	flags.StringP("username", "u", "root", "The ssh server username")
-	flags.StringP("password", "p", "", "The ssh server password")
 	flags.StringP("filename", "f", "", "A script file passed to the ssh server for execution, the flag is mutually exclusive with other flag '--cmd'")
+	flags.String("remote-dir", rssh.DefaultWorkDir, "The remote directory in which a private directory holding the script is created, the home directory is used if it can't be written to")
+	flags.Bool("keep-remote", false, "Keep the uploaded script on the remote hosts instead of removing it once run")
+	flags.String("interpreter", "", "The interpreter running the script with its arguments, e.g. 'python3 -u'. By default the shebang line of the script is honoured, falling back to bash or sh")
+	flags.StringArrayP("env", "e", nil, "'KEY=VALUE', An environment variable of the command or script, may be given multiple times")
+	flags.String("env-file", "", "A file of KEY=VALUE lines setting environment variables of the command or script, --env takes precedence")
+	flags.Bool("stdin", false, "Read local stdin once and feed it to the command or script on every host, e.g. to push a file through tee")
+	flags.String("stdin-file", "", "A local file fed to the stdin of the command or script on every host, the flag is mutually exclusive with other flag '--stdin'")
+	flags.Bool("stream", false, "Print output lines as they arrive, prefixed with the host address, followed by a summary of the exit statuses")
+	flags.Bool("aggregate", false, "Print hosts with identical stdout, stderr and exit status as one block listing the hosts, the largest groups first")
 	flags.String("cmd", "", "A command passed to the ssh server for execution, the flag is mutually exclusive with other flag '--filename'")
 }
 
@@ -53,50 +67,184 @@ func prettyPrint(resps []rssh.Response) {
 	failed := color.New(color.FgRed)
 
 	for _, resp := range resps {
-		if resp.ExitStatus == 0 {
-			success.Printf(">>> %s\n", resp.Addr)
-			fmt.Println(resp.Output)
+		if resp.ExitStatus == 0 && resp.Err == nil {
+			success.Printf(">>> %s%s\n", resp.Addr, cli.AttemptsNote(resp.Attempts))
+			fmt.Println(strings.TrimSuffix(resp.Stdout, "\n"))
+			if resp.Stderr != "" {
+				fmt.Printf("[stderr]\n%s\n", strings.TrimSuffix(resp.Stderr, "\n"))
+			}
 		} else {
-			failed.Printf(">>> %s\n", resp.Addr)
+			failed.Printf(">>> %s%s\n", resp.Addr, cli.AttemptsNote(resp.Attempts))
 			fmt.Println(resp.Err)
+			if resp.Stdout != "" {
+				fmt.Printf("[stdout]\n%s\n", strings.TrimSuffix(resp.Stdout, "\n"))
+			}
+			if resp.Stderr != "" {
+				fmt.Printf("[stderr]\n%s\n", strings.TrimSuffix(resp.Stderr, "\n"))
+			}
+		}
+		if resp.KeptScript != "" {
+			fmt.Printf("[script kept at %s]\n", resp.KeptScript)
 		}
 		fmt.Println()
 	}
 }
 
-func getClientConfigs() ([]rssh.ClientConfig, error) {
-	cfgs := []rssh.ClientConfig{}
-
-	addrs := viper.Get("addrs")
-	v, ok := addrs.(string)
-	if ok {
-		l := strings.Split(v, ",")
-		for _, addr := range l {
-			cfg := rssh.ClientConfig{
-				Addr:     addr,
-				Username: viper.GetString("username"),
-				Password: viper.GetString("password"),
-			}
-			cfgs = append(cfgs, cfg)
+// spoolStdin copies local stdin to a temporary file which every host reads
+// on its own, the caller removes it
+func spoolStdin() (string, error) {
+	f, err := os.CreateTemp("", "rexec-stdin-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to spool stdin, %s", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, os.Stdin); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to read stdin, %s", err)
+	}
+	return f.Name(), nil
+}
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// getEnv returns the KEY=VALUE variables of --env-file followed by --env
+func getEnv() ([]string, error) {
+	env := []string{}
+	if path := viper.GetString("env-file"); path != "" {
+		vars, err := readEnvFile(path)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, vars...)
+	}
+	for _, kv := range viper.GetStringSlice("env") {
+		if k, _, _ := strings.Cut(kv, "="); !envName.MatchString(k) || !strings.Contains(kv, "=") {
+			return nil, fmt.Errorf("invalid environment variable %q, must be KEY=VALUE", kv)
 		}
-	} else {
-		viper.UnmarshalKey("addrs", &cfgs)
+		env = append(env, kv)
+	}
+	return env, nil
+}
+
+// readEnvFile parses a file of KEY=VALUE lines, blank lines and comments are
+// skipped, an 'export ' prefix and quotes around the value are allowed
+func readEnvFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env file, %s", err)
 	}
 
-	for i, v := range cfgs {
-		addrS := strings.Split(v.Addr, ":")
-		if len(addrS) == 2 {
+	env := []string{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		if len(addrS) == 1 {
-			defaultPort := "22"
-			addr := fmt.Sprintf("%s:%s", addrS[0], defaultPort)
-			v.Addr = addr
-			cfgs[i] = v
-			continue
+		line = strings.TrimPrefix(line, "export ")
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || !envName.MatchString(k) {
+			return nil, fmt.Errorf("%s:%d: invalid line, must be KEY=VALUE", path, i+1)
 		}
-		return nil, fmt.Errorf("Host addr %s is incorrect", v.Addr)
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		env = append(env, k+"="+v)
 	}
+	return env, nil
+}
 
-	return cfgs, nil
+// hostColors are used in turn for the host prefix of streamed output
+var hostColors = []color.Attribute{
+	color.FgCyan, color.FgMagenta, color.FgYellow, color.FgBlue, color.FgGreen,
+	color.FgHiCyan, color.FgHiMagenta, color.FgHiYellow, color.FgHiBlue, color.FgHiGreen,
+}
+
+// newLinePrinter returns a rssh.LineFunc printing each line prefixed with
+// the colourised address of its host, like pdsh does
+func newLinePrinter(cfgs []rssh.ClientConfig) rssh.LineFunc {
+	width := 0
+	prefixes := map[string]string{}
+	for _, cfg := range cfgs {
+		if len(cfg.Addr) > width {
+			width = len(cfg.Addr)
+		}
+	}
+	for i, cfg := range cfgs {
+		c := color.New(hostColors[i%len(hostColors)])
+		prefixes[cfg.Addr] = c.Sprintf("%-*s |", width, cfg.Addr)
+	}
+
+	var mu sync.Mutex
+	return func(addr string, stderr bool, line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if stderr {
+			fmt.Fprintln(os.Stderr, prefixes[addr], line)
+			return
+		}
+		fmt.Fprintln(os.Stdout, prefixes[addr], line)
+	}
+}
+
+// printSummary prints the result of every host without its output, which
+// was already streamed
+func printSummary(resps []rssh.Response) {
+	success := color.New(color.FgGreen)
+	failed := color.New(color.FgRed)
+
+	fmt.Println()
+	for _, resp := range resps {
+		if resp.ExitStatus == 0 && resp.Err == nil {
+			success.Printf(">>> %s: ok (%s)\n", resp.Addr, resp.Duration.Round(time.Millisecond))
+		} else {
+			failed.Printf(">>> %s: %s (%s)\n", resp.Addr, resp.Err, resp.Duration.Round(time.Millisecond))
+		}
+		if resp.KeptScript != "" {
+			fmt.Printf("script kept at %s\n", resp.KeptScript)
+		}
+	}
+}
+
+// toResults converts responses to the machine readable results
+func toResults(resps []rssh.Response) []output.Result {
+	results := []output.Result{}
+	for _, resp := range resps {
+		r := output.NewResult(resp.Addr, resp.Err, cli.Unreachable(resp.Err), resp.Duration)
+		r.ExitStatus = resp.ExitStatus
+		r.Signal = resp.Signal
+		r.Attempts = resp.Attempts
+		r.Stdout = resp.Stdout
+		r.Stderr = resp.Stderr
+		r.KeptScript = resp.KeptScript
+		if resp.Err == nil && resp.ExitStatus != 0 {
+			r.Status = output.StatusFailed
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// newResultPrinter returns a function printing responses in format
+func newResultPrinter(format string) func([]rssh.Response) {
+	return func(resps []rssh.Response) {
+		if err := output.Print(os.Stdout, format, toResults(resps)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// resultError returns the error carrying the exit code of the run
+func resultError(resps []rssh.Response) error {
+	errs := []error{}
+	failed := 0
+	for _, resp := range resps {
+		errs = append(errs, resp.Err)
+		if resp.Err != nil || resp.ExitStatus != 0 {
+			failed++
+		}
+	}
+	return cli.ResultError(errs, failed)
 }
@@ -2,8 +2,12 @@ package rexec
 
 import (
 	"fmt"
-	"log"
+	"os"
+	"sshtools/internal/pkg/cli"
+	"sshtools/internal/pkg/exitcode"
+	"sshtools/internal/pkg/output"
 	"sshtools/internal/pkg/rssh"
+	"sshtools/internal/pkg/sshconn"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -15,16 +19,21 @@ var (
 )
 
 func NewRExecCommand() *cobra.Command {
-	cobra.OnInitialize(printVersionAndExist, initConfig)
+	cobra.OnInitialize(printVersionAndExist)
 	cmd := &cobra.Command{
-		Use:          "rexec",
+		Use:          "rexec [flags] [-- script args...]",
 		Short:        "Execute command or script concurrently on multiple SSH servers",
 		SilenceUsage: true,
 		RunE:         run,
 		Args: func(cmd *cobra.Command, args []string) error {
-			for _, arg := range args {
+			// Only the arguments after '--' are accepted, they go to the script
+			dash := cmd.ArgsLenAtDash()
+			if dash < 0 {
+				dash = len(args)
+			}
+			for _, arg := range args[:dash] {
 				if len(arg) > 0 {
-					return fmt.Errorf("%q does not take any arguments, got %q", cmd.CommandPath(), args)
+					return fmt.Errorf("%q does not take any arguments, got %q, pass script arguments after '--'", cmd.CommandPath(), args[:dash])
 				}
 			}
 			return nil
@@ -37,6 +46,7 @@ func NewRExecCommand() *cobra.Command {
 	flags.BoolVarP(&ver, "version", "V", false, "Print version information and exist")
 	cmd.MarkFlagsMutuallyExclusive("config", "addrs")
 	cmd.MarkFlagsMutuallyExclusive("cmd", "filename")
+	cmd.MarkFlagsMutuallyExclusive("stdin", "stdin-file")
 
 	checkArgs(cmd)
 	return cmd
@@ -44,31 +54,107 @@ func NewRExecCommand() *cobra.Command {
 
 func run(cmd *cobra.Command, args []string) error {
 	if err := viper.BindPFlags(cmd.Flags()); err != nil {
-		log.Fatal(err)
+		return exitcode.New(exitcode.Usage, err)
+	}
+	if err := initConfig(); err != nil {
+		return exitcode.New(exitcode.Usage, err)
+	}
+	if viper.GetBool("verbose") {
+		sshconn.SetVerbose(os.Stderr)
 	}
 
-	cfgs, err := getClientConfigs()
+	format := viper.GetString("output")
+	if err := output.ValidateFormat(format); err != nil {
+		return exitcode.New(exitcode.Usage, err)
+	}
+	stream := viper.GetBool("stream")
+	if stream && format != output.Text {
+		return exitcode.Errorf(exitcode.Usage, "--stream can't be used with the %s output format", format)
+	}
+	aggregate := viper.GetBool("aggregate")
+	if aggregate && (stream || format != output.Text) {
+		return exitcode.Errorf(exitcode.Usage, "--aggregate can't be used with --stream or the %s output format", format)
+	}
+	printResps := prettyPrint
+	if stream {
+		printResps = printSummary
+	}
+	if aggregate {
+		printResps = aggregatePrint
+	}
+	if format != output.Text {
+		printResps = newResultPrinter(format)
+	}
+	command := viper.GetString("cmd")
+	scriptFile := viper.GetString("filename")
+	if command == "" && scriptFile == "" {
+		return exitcode.Errorf(exitcode.Usage, "one of --cmd or --filename is required")
+	}
+	var scriptArgs []string
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		scriptArgs = args[dash:]
+	}
+	if len(scriptArgs) > 0 && scriptFile == "" {
+		return exitcode.Errorf(exitcode.Usage, "arguments after '--' are only passed to scripts given with --filename")
+	}
+	env, err := getEnv()
 	if err != nil {
-		log.Fatal(err)
+		return exitcode.New(exitcode.Usage, err)
+	}
+	stdinFile := viper.GetString("stdin-file")
+	if stdinFile != "" {
+		if _, err := os.Stat(stdinFile); err != nil {
+			return exitcode.New(exitcode.Usage, err)
+		}
+	}
+	if viper.GetBool("stdin") {
+		if stdinFile, err = spoolStdin(); err != nil {
+			return exitcode.New(exitcode.Usage, err)
+		}
+		defer os.Remove(stdinFile)
 	}
 
-	mc, err := rssh.NewMultiClient(cfgs)
+	cfgs, err := cli.HostConfigs()
 	if err != nil {
-		log.Fatal(err)
+		return exitcode.New(exitcode.Usage, err)
 	}
+
+	p, err := cli.NewPool()
+	if err != nil {
+		return exitcode.New(exitcode.Usage, err)
+	}
+
+	ctx, cancel := cli.NewContext()
+	defer cancel()
+
+	mc, failed := rssh.NewMultiClient(ctx, cfgs, p)
 	defer mc.Close()
+	if err := cli.CheckConnected(len(cfgs), len(failed)); err != nil {
+		printResps(failed)
+		return exitcode.New(exitcode.Unreachable, err)
+	}
 
-	command := viper.GetString("cmd")
-	if command != "" {
-		resps := mc.ExecCmd(command)
-		prettyPrint(resps)
+	opts := rssh.ExecOptions{
+		Timeout:     viper.GetDuration("timeout"),
+		Env:         env,
+		Args:        scriptArgs,
+		Interpreter: viper.GetString("interpreter"),
+		WorkDir:     viper.GetString("remote-dir"),
+		KeepRemote:  viper.GetBool("keep-remote"),
+		StdinFile:   stdinFile,
+	}
+	if stream {
+		opts.OnLine = newLinePrinter(cfgs)
 	}
 
-	scriptFile := viper.GetString("filename")
-	if scriptFile != "" {
-		resps := mc.ExecShellScript(scriptFile)
-		prettyPrint(resps)
+	var resps []rssh.Response
+	if command != "" {
+		resps = mc.ExecCmd(ctx, command, opts)
+	} else {
+		resps = mc.ExecShellScript(ctx, scriptFile, opts)
 	}
+	resps = append(failed, resps...)
+	printResps(resps)
 
-	return nil
+	return resultError(resps)
 }